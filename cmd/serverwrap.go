@@ -12,6 +12,12 @@ import (
 	"go.uber.org/zap"
 )
 
+// Maximum length of the output sent with readiness and crash notifications
+const outputReportLength = 1500
+
+// Delay between two checks of the hang watchdog
+const watchdogCheckInterval = 5 * time.Second
+
 var (
 	Version   = "dev"
 	Commit    = "none"
@@ -19,6 +25,63 @@ var (
 )
 
 func main() {
+	// The subcommands take the place of the wrapped command. A leading "--"
+	// wraps a command named like one of them.
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "console":
+			os.Exit(console())
+		case "sniff-test":
+			os.Exit(sniffTest())
+		case "--":
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+		}
+	}
+	os.Exit(run())
+}
+
+// console attaches the terminal to the console of a running wrapper. The
+// socket is taken from the command line, or from LSDC2_CONSOLE_SOCKET.
+func console() int {
+	socket := os.Getenv("LSDC2_CONSOLE_SOCKET")
+	if len(os.Args) > 2 {
+		socket = os.Args[2]
+	}
+	if socket == "" {
+		socket = internal.DefaultConsoleSocket
+	}
+	if err := internal.RunConsoleClient(socket); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// sniffTest prints the live matches of the sniff filters, with the
+// interfaces and filters resolved from the env as the wrapper does. Matched
+// packets are captured to the pcap file given on the command line, if any,
+// rather than to LSDC2_SNIFF_CAPTURE which a running wrapper may be writing.
+func sniffTest() int {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync()
+
+	os.Unsetenv("LSDC2_OUTPUT_DIR")
+	os.Unsetenv("LSDC2_SNIFF_CAPTURE")
+	if len(os.Args) > 2 {
+		os.Setenv("LSDC2_SNIFF_CAPTURE", os.Args[2])
+	}
+	wrapped := internal.NewWrapped(logger, nil)
+	wrapped.DetectIfaceAndAddHostFilter()
+	if err := wrapped.SniffTest(os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// run wraps the process and return the exit code of the wrapper. It is kept
+// apart from main so that deferred calls are done before exiting.
+func run() (exitCode int) {
 	var logger *zap.Logger
 	if os.Getenv("DEBUG") != "" {
 		logger, _ = zap.NewDevelopment()
@@ -45,34 +108,86 @@ func main() {
 		}
 	}
 
+	// Adopt orphaned descendants of the process to reap them
+	if wrapped.Subreaper {
+		if err := wrapped.BecomeSubreaper(); err != nil {
+			logger.Error("error in BecomeSubreaper", zap.Error(err))
+		}
+	}
+
 	// Prepare BPF to filter on incomming IP4 packes
 	wrapped.DetectIfaceAndAddHostFilter()
+	wrapped.StartActivityMonitor()
 
 	// Start the process
 	wrapped.StartProcess()
+	wrapped.StartQueryProber()
 
 	// Start monitoring channels
-	pollingC := make(chan bool)
 	terminationCheckTicker := time.NewTicker(wrapped.TerminationCheckInterval)
 	lowMemoryCheckTicker := time.NewTicker(wrapped.TerminationCheckInterval)
-	sniffTicker := time.NewTicker(wrapped.SniffInterval)
 	emptyTicker := time.NewTicker(wrapped.EmptyTimeout)
+	readyTimer := time.NewTimer(wrapped.ReadyTimeout)
+	readyRestarts := 0
+	watchdogTicker := time.NewTicker(watchdogCheckInterval)
+	livenessTicker := time.NewTicker(wrapped.LivenessInterval)
+	hangRestarts := 0
+	lastActivity := time.Time{}
 
 	sigC := make(chan os.Signal, 1)
-	signal.Notify(sigC, syscall.SIGTERM, syscall.SIGINT)
+	signal.Notify(sigC, append([]os.Signal{syscall.SIGTERM, syscall.SIGINT}, wrapped.ForwardedSignals()...)...)
+
+	chldC := make(chan os.Signal, 1)
+	if wrapped.ReapsOrphans() {
+		signal.Notify(chldC, syscall.SIGCHLD)
+	}
 
+	var stopReason internal.StopReason
 	defer func() {
 		terminationCheckTicker.Stop()
 		lowMemoryCheckTicker.Stop()
-		sniffTicker.Stop()
 		emptyTicker.Stop()
-		wrapped.StopProcess()
+		readyTimer.Stop()
+		watchdogTicker.Stop()
+		livenessTicker.Stop()
+		wrapped.StopProcess(stopReason)
+		exitCode = wrapped.ExitCode()
+		logger.Info("exiting", zap.Stringer("reason", stopReason), zap.Int("exitCode", exitCode))
 	}()
 
 	if !wrapped.InEc2Instance {
 		terminationCheckTicker.Stop()
 	}
 
+	if wrapped.ReadyTimeout == 0 {
+		readyTimer.Stop()
+	}
+
+	// The watchdog runs once the server is ready, as it may be silent while
+	// booting, or from the start when readiness is not detected. It stops
+	// while the process restarts.
+	watchdogTicker.Stop()
+	livenessTicker.Stop()
+	armWatchdog := func() {
+		if wrapped.HangTimeout > 0 || wrapped.LivenessCommand != "" {
+			watchdogTicker.Reset(watchdogCheckInterval)
+		}
+		if wrapped.LivenessCommand != "" {
+			livenessTicker.Reset(wrapped.LivenessInterval)
+		}
+	}
+	restartProcess := func(save bool) {
+		watchdogTicker.Stop()
+		livenessTicker.Stop()
+		wrapped.RestartProcess(save)
+		if !wrapped.DetectsReadiness() {
+			armWatchdog()
+		}
+	}
+	if !wrapped.DetectsReadiness() {
+		armWatchdog()
+	}
+
 	if wrapped.LowMemoryWarningThresholdMiB == 0 && wrapped.LowMemorySignalThresholdMiB == 0 {
 		lowMemoryCheckTicker.Stop()
 	}
@@ -80,18 +195,68 @@ func main() {
 	logger.Info("start monitoring network and signals")
 	for {
 		select {
-		case packetFound := <-pollingC:
-			if packetFound {
-				logger.Debug("network activity detected")
+		case activity := <-wrapped.NetworkActive():
+			lastActivity = activity.Time
+			// Connected players keep the empty ticker disarmed, and a
+			// count reported by the server overrides the network
+			if wrapped.PlayerCount() == 0 && !wrapped.PlayersReported() {
+				logger.Debug("network activity detected", zap.Int("clients", activity.Clients), zap.Int64("packets", activity.Packets), zap.Int64("bytes", activity.Bytes))
+				emptyTicker.Reset(wrapped.EmptyTimeout)
+			}
+		case playerCount := <-wrapped.PlayersChanged():
+			if playerCount > 0 {
+				logger.Debug("players connected, empty ticker disarmed", zap.Int("players", playerCount))
+				emptyTicker.Stop()
+			} else {
+				logger.Debug("no more players, empty ticker armed")
 				emptyTicker.Reset(wrapped.EmptyTimeout)
 			}
-		case <-sniffTicker.C:
-			go func() {
-				pollingC <- wrapped.PollProcessPackets()
-			}()
+		case <-wrapped.Ready():
+			readyTimer.Stop()
+			armWatchdog()
+		case <-readyTimer.C:
+			logger.Warn("server not ready in time", zap.Duration("timeout", wrapped.ReadyTimeout), zap.String("action", wrapped.ReadyTimeoutAction))
+			wrapped.NotifyBackend("error", fmt.Sprintf("Server not ready after %v. Last output:\n%s", wrapped.ReadyTimeout, wrapped.LastOutput(outputReportLength)))
+			switch {
+			case wrapped.ReadyTimeoutAction == internal.ReadyActionWait:
+			case wrapped.ReadyTimeoutAction == internal.ReadyActionRestart && readyRestarts < wrapped.ReadyMaxRestarts:
+				readyRestarts++
+				wrapped.NotifyBackend("warning", fmt.Sprintf("Restarting server (attempt %d/%d)", readyRestarts, wrapped.ReadyMaxRestarts))
+				restartProcess(false)
+				readyTimer.Reset(wrapped.ReadyTimeout)
+			default:
+				wrapped.NotifyBackend("error", "Server not ready. Terminating instance.")
+				stopReason = internal.StopNotReady
+				return
+			}
+		case <-livenessTicker.C:
+			wrapped.ProbeLiveness()
+		case <-watchdogTicker.C:
+			// Without player tracking, network activity tells that the
+			// server is in use
+			busy := time.Since(lastActivity) < 2*wrapped.SniffInterval
+			if wrapped.TracksPlayers() {
+				busy = wrapped.PlayerCount() > 0
+			}
+			why, hung := wrapped.Hung(busy)
+			if !hung {
+				continue
+			}
+			logger.Warn("server hung", zap.String("why", why))
+			wrapped.NotifyBackend("error", fmt.Sprintf("%s\nLast output:\n%s", wrapped.WithPlayers(fmt.Sprintf("Server hung (%s)", why)), wrapped.LastOutput(outputReportLength)))
+			if hangRestarts < wrapped.HangMaxRestarts {
+				hangRestarts++
+				wrapped.NotifyBackend("warning", fmt.Sprintf("Saving and restarting server (attempt %d/%d)", hangRestarts, wrapped.HangMaxRestarts))
+				restartProcess(true)
+				continue
+			}
+			wrapped.NotifyBackend("error", "Server keeps hanging. Terminating instance.")
+			stopReason = internal.StopHang
+			return
 		case <-emptyTicker.C:
 			logger.Info("server empty for too long")
 			wrapped.NotifyBackend("info", "Server empty. Terminating instance.")
+			stopReason = internal.StopEmpty
 			return
 		case <-terminationCheckTicker.C:
 			logger.Debug("checking SPOT termination")
@@ -102,7 +267,8 @@ func main() {
 			}
 			if terminationNotified {
 				logger.Info("spot termination detected")
-				wrapped.NotifyBackend("warning", "SPOT termination detected. Terminating instance.")
+				wrapped.NotifyBackend("warning", wrapped.WithPlayers("SPOT termination detected. Terminating instance."))
+				stopReason = internal.StopSpotTermination
 				return
 			}
 		case <-lowMemoryCheckTicker.C:
@@ -114,15 +280,41 @@ func main() {
 			}
 			if freeMemoryMib < wrapped.LowMemorySignalThresholdMiB {
 				logger.Warn("low memory signal", zap.Int64("freeMemory", freeMemoryMib))
-				wrapped.NotifyBackend("warning", fmt.Sprintf("Memory limit breached (%d MiB). Terminating instance.", freeMemoryMib))
+				wrapped.NotifyBackend("warning", wrapped.WithPlayers(fmt.Sprintf("Memory limit breached (%d MiB). Terminating instance.", freeMemoryMib)))
+				stopReason = internal.StopLowMemory
 				return
 			} else if freeMemoryMib < wrapped.LowMemoryWarningThresholdMiB {
 				logger.Warn("low memory warning", zap.Int64("freeMemory", freeMemoryMib))
 				wrapped.NotifyBackend("warning", fmt.Sprintf("Low memory warning (%d MiB)", freeMemoryMib))
 			}
-		case <-sigC:
-			logger.Info("received signal")
-			wrapped.NotifyBackend("warning", "Signal received. Terminating instance.")
+		case <-chldC:
+			wrapped.ReapOrphans()
+		case sig := <-sigC:
+			if wrapped.ForwardSignal(sig) {
+				continue
+			}
+			logger.Info("received signal", zap.Stringer("signal", sig))
+			wrapped.NotifyBackend("warning", wrapped.WithPlayers("Signal received. Terminating instance."))
+			stopReason = internal.StopSignal
+			return
+		case msg := <-wrapped.StopRequested():
+			logger.Info("stop requested by rule")
+			wrapped.NotifyBackend("info", wrapped.WithPlayers(fmt.Sprintf("%s. Terminating instance.", msg)))
+			stopReason = internal.StopRule
+			return
+		case <-wrapped.ProcessExited():
+			processExitCode := wrapped.ProcessExitCode()
+			logger.Info("process exited by itself", zap.Int("exitCode", processExitCode))
+			if processExitCode != 0 {
+				msg := fmt.Sprintf("Server crashed (exit code %d). Terminating instance.", processExitCode)
+				if wrapped.OomKilled() {
+					msg = fmt.Sprintf("Server killed by its memory limit (exit code %d). Terminating instance.", processExitCode)
+				}
+				wrapped.NotifyBackend("error", fmt.Sprintf("%s\nLast output:\n%s", wrapped.WithPlayers(msg), wrapped.LastOutput(outputReportLength)))
+			} else {
+				wrapped.NotifyBackend("info", "Server stopped. Terminating instance.")
+			}
+			stopReason = internal.StopProcessExited
 			return
 		}
 	}
@@ -15,6 +15,7 @@ require (
 	github.com/aws/smithy-go v1.22.3
 	github.com/caarlos0/env v3.5.0+incompatible
 	go.uber.org/zap v1.27.0
+	golang.org/x/net v0.37.0
 	golang.org/x/sys v0.31.0
 )
 
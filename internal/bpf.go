@@ -0,0 +1,555 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// errUnsupportedFilter is returned for filters outside of the subset the
+// pure Go compiler knows. They need a build with the pcap tag.
+var errUnsupportedFilter = errors.New("unsupported filter")
+
+// Loads at skfNetOff+k read the packet from its network header, whatever the
+// link layer, so that programs work on any interface including "any"
+const skfNetOff = 0xfff00000
+
+// Protocols matched by filters
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+	protoICMP     = 1
+	protoTCP      = 6
+	protoUDP      = 17
+	protoICMPv6   = 58
+	protoSCTP     = 132
+)
+
+// compileBPFFilter compiles a pcap filter expression into a classic BPF
+// program to attach to a packet socket. The common subset (host, net, port
+// and protocols combined with and/or/not) is compiled in Go; other filters
+// are handed to libpcap when built with the pcap tag.
+func compileBPFFilter(iface string, filter string) ([]unix.SockFilter, error) {
+	program, err := compileFilter(filter)
+	if errors.Is(err, errUnsupportedFilter) {
+		return compilePcapFilter(iface, filter, err)
+	}
+	return program, err
+}
+
+// compileFilter compiles filter with the pure Go compiler
+func compileFilter(filter string) ([]unix.SockFilter, error) {
+	p := &filterParser{tokens: tokenizeFilter(filter)}
+	var root filterNode = filterAnd{}
+	if len(p.tokens) > 0 {
+		var err error
+		if root, err = p.parseOr(); err != nil {
+			return nil, err
+		}
+		if p.pos < len(p.tokens) {
+			return nil, fmt.Errorf("%w: unexpected %q", errUnsupportedFilter, p.tokens[p.pos])
+		}
+	}
+
+	g := &filterGen{}
+	accept, reject := g.newLabel(), g.newLabel()
+	root.gen(g, accept, reject)
+	g.place(accept)
+	g.insns = append(g.insns, bpf.RetConstant{Val: MTU})
+	g.place(reject)
+	g.insns = append(g.insns, bpf.RetConstant{Val: 0})
+	if err := g.resolve(); err != nil {
+		return nil, err
+	}
+
+	raw, err := bpf.Assemble(g.insns)
+	if err != nil {
+		return nil, fmt.Errorf("bpf.Assemble / %w", err)
+	}
+	program := make([]unix.SockFilter, len(raw))
+	for i, insn := range raw {
+		program[i] = unix.SockFilter{Code: insn.Op, Jt: insn.Jt, Jf: insn.Jf, K: insn.K}
+	}
+	return program, nil
+}
+
+// tokenizeFilter splits a filter into words, parentheses and operators
+func tokenizeFilter(filter string) []string {
+	tokens := []string{}
+	word := strings.Builder{}
+	flush := func() {
+		if word.Len() > 0 {
+			tokens = append(tokens, word.String())
+			word.Reset()
+		}
+	}
+	for i := 0; i < len(filter); i++ {
+		c := filter[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			flush()
+		case c == '(' || c == ')':
+			flush()
+			tokens = append(tokens, string(c))
+		case c == '!' && (i+1 == len(filter) || filter[i+1] != '='):
+			flush()
+			tokens = append(tokens, "not")
+		case strings.HasPrefix(filter[i:], "&&"):
+			flush()
+			tokens = append(tokens, "and")
+			i++
+		case strings.HasPrefix(filter[i:], "||"):
+			flush()
+			tokens = append(tokens, "or")
+			i++
+		default:
+			word.WriteByte(c)
+		}
+	}
+	flush()
+	return tokens
+}
+
+// filterParser parses the tokens of a filter with the precedence of pcap:
+// not binds tighter than and, which binds tighter than or
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *filterParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *filterParser) next() string {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	node, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	nodes := filterOr{node}
+	for p.peek() == "or" {
+		p.next()
+		if node, err = p.parseAnd(); err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+	if len(nodes) == 1 {
+		return nodes[0], nil
+	}
+	return nodes, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	node, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	nodes := filterAnd{node}
+	for p.peek() == "and" {
+		p.next()
+		if node, err = p.parseNot(); err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+	if len(nodes) == 1 {
+		return nodes[0], nil
+	}
+	return nodes, nil
+}
+
+func (p *filterParser) parseNot() (filterNode, error) {
+	switch p.peek() {
+	case "not":
+		p.next()
+		node, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return filterNot{node}, nil
+	case "(":
+		p.next()
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("%w: missing )", errUnsupportedFilter)
+		}
+		return node, nil
+	}
+	return p.parsePrimitive()
+}
+
+// parsePrimitive parses "[proto] [src|dst] host|net|port value", or a lone
+// protocol
+func (p *filterParser) parsePrimitive() (filterNode, error) {
+	proto := ""
+	switch p.peek() {
+	case "ip", "ip6", "tcp", "udp", "sctp", "icmp", "icmp6":
+		proto = p.next()
+	}
+	dir := ""
+	switch p.peek() {
+	case "src", "dst":
+		dir = p.next()
+	}
+
+	kind := p.peek()
+	switch kind {
+	case "host", "net", "port":
+		p.next()
+	default:
+		if proto != "" && dir == "" {
+			return protoNode(proto)
+		}
+		return nil, fmt.Errorf("%w: unexpected %q", errUnsupportedFilter, kind)
+	}
+	value := p.next()
+
+	switch kind {
+	case "host":
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("%w: invalid host %q", errUnsupportedFilter, value)
+		}
+		bits := 128
+		if ip.To4() != nil {
+			bits = 32
+		}
+		return netNode(proto, dir, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	case "net":
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid net %q", errUnsupportedFilter, value)
+		}
+		return netNode(proto, dir, ipNet)
+	default:
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid port %q", errUnsupportedFilter, value)
+		}
+		return portNode(proto, dir, uint32(port))
+	}
+}
+
+// protoNode matches a protocol, over IPv4 and IPv6 when both carry it
+func protoNode(proto string) (filterNode, error) {
+	switch proto {
+	case "ip":
+		return isIPv4, nil
+	case "ip6":
+		return isIPv6, nil
+	case "tcp":
+		return filterOr{ipv4Proto(protoTCP), ipv6Proto(protoTCP)}, nil
+	case "udp":
+		return filterOr{ipv4Proto(protoUDP), ipv6Proto(protoUDP)}, nil
+	case "sctp":
+		return filterOr{ipv4Proto(protoSCTP), ipv6Proto(protoSCTP)}, nil
+	case "icmp":
+		return ipv4Proto(protoICMP), nil
+	case "icmp6":
+		return ipv6Proto(protoICMPv6), nil
+	}
+	return nil, fmt.Errorf("%w: unexpected %q", errUnsupportedFilter, proto)
+}
+
+// netNode matches the source or destination address against a network
+func netNode(proto string, dir string, ipNet *net.IPNet) (filterNode, error) {
+	if proto != "" && proto != "ip" && proto != "ip6" {
+		return nil, fmt.Errorf("%w: %s qualifier on an address", errUnsupportedFilter, proto)
+	}
+	// Offsets of the source and destination addresses in the header
+	offsets := map[string]uint32{"src": 12, "dst": 16}
+	version := isIPv4
+	ip4 := ipNet.IP.To4()
+	ip := ip4
+	mask := ipNet.Mask
+	if ip == nil {
+		offsets = map[string]uint32{"src": 8, "dst": 24}
+		version = isIPv6
+		ip = ipNet.IP.To16()
+	}
+	if (proto == "ip" && ip4 == nil) || (proto == "ip6" && ip4 != nil) {
+		return nil, fmt.Errorf("%w: %s qualifier on %v", errUnsupportedFilter, proto, ipNet)
+	}
+
+	match := func(offset uint32) filterNode {
+		words := filterAnd{}
+		for i := 0; i+4 <= len(ip); i += 4 {
+			wordMask := uint32(mask[i])<<24 | uint32(mask[i+1])<<16 | uint32(mask[i+2])<<8 | uint32(mask[i+3])
+			if wordMask == 0 {
+				continue
+			}
+			word := uint32(ip[i])<<24 | uint32(ip[i+1])<<16 | uint32(ip[i+2])<<8 | uint32(ip[i+3])
+			loads := []bpf.Instruction{bpf.LoadAbsolute{Off: skfNetOff + offset + uint32(i), Size: 4}}
+			if wordMask != 0xffffffff {
+				loads = append(loads, bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: wordMask})
+			}
+			words = append(words, filterTest{loads: loads, cond: bpf.JumpEqual, val: word & wordMask})
+		}
+		return words
+	}
+	return filterAnd{version, directed(dir, match(offsets["src"]), match(offsets["dst"]))}, nil
+}
+
+// portNode matches the source or destination port of TCP, UDP and SCTP, or
+// of the given protocol. Like pcap, IPv4 fragments other than the first are
+// not matched, they carry no port.
+func portNode(proto string, dir string, port uint32) (filterNode, error) {
+	protos := []uint32{}
+	switch proto {
+	case "", "ip", "ip6":
+		protos = []uint32{protoTCP, protoUDP, protoSCTP}
+	case "tcp":
+		protos = []uint32{protoTCP}
+	case "udp":
+		protos = []uint32{protoUDP}
+	case "sctp":
+		protos = []uint32{protoSCTP}
+	default:
+		return nil, fmt.Errorf("%w: %s qualifier on a port", errUnsupportedFilter, proto)
+	}
+
+	ipv4Protos, ipv6Protos := filterOr{}, filterOr{}
+	for _, p := range protos {
+		ipv4Protos = append(ipv4Protos, ipv4Proto(p))
+		ipv6Protos = append(ipv6Protos, ipv6Proto(p))
+	}
+
+	ipv4Port := func(offset uint32) filterNode {
+		return filterTest{
+			loads: []bpf.Instruction{
+				bpf.LoadMemShift{Off: skfNetOff},
+				bpf.LoadIndirect{Off: skfNetOff + offset, Size: 2},
+			},
+			cond: bpf.JumpEqual,
+			val:  port,
+		}
+	}
+	ipv6Port := func(offset uint32) filterNode {
+		return filterTest{
+			loads: []bpf.Instruction{bpf.LoadAbsolute{Off: skfNetOff + 40 + offset, Size: 2}},
+			cond:  bpf.JumpEqual,
+			val:   port,
+		}
+	}
+	notFragment := filterTest{
+		loads: []bpf.Instruction{bpf.LoadAbsolute{Off: skfNetOff + 6, Size: 2}},
+		cond:  bpf.JumpBitsNotSet,
+		val:   0x1fff,
+	}
+
+	ipv4 := filterAnd{ipv4Protos, notFragment, directed(dir, ipv4Port(0), ipv4Port(2))}
+	ipv6 := filterAnd{ipv6Protos, directed(dir, ipv6Port(0), ipv6Port(2))}
+	switch proto {
+	case "ip":
+		return ipv4, nil
+	case "ip6":
+		return ipv6, nil
+	}
+	return filterOr{ipv4, ipv6}, nil
+}
+
+// directed picks the source or destination test, or either of them
+func directed(dir string, src filterNode, dst filterNode) filterNode {
+	switch dir {
+	case "src":
+		return src
+	case "dst":
+		return dst
+	}
+	return filterOr{src, dst}
+}
+
+var (
+	isIPv4 = filterTest{loads: []bpf.Instruction{bpf.LoadExtension{Num: bpf.ExtProto}}, cond: bpf.JumpEqual, val: etherTypeIPv4}
+	isIPv6 = filterTest{loads: []bpf.Instruction{bpf.LoadExtension{Num: bpf.ExtProto}}, cond: bpf.JumpEqual, val: etherTypeIPv6}
+)
+
+func ipv4Proto(proto uint32) filterNode {
+	return filterAnd{isIPv4, filterTest{loads: []bpf.Instruction{bpf.LoadAbsolute{Off: skfNetOff + 9, Size: 1}}, cond: bpf.JumpEqual, val: proto}}
+}
+
+func ipv6Proto(proto uint32) filterNode {
+	return filterAnd{isIPv6, filterTest{loads: []bpf.Instruction{bpf.LoadAbsolute{Off: skfNetOff + 6, Size: 1}}, cond: bpf.JumpEqual, val: proto}}
+}
+
+// filterNode is a node of a parsed filter, generating the code jumping to
+// accept if the packet matches, to reject otherwise
+type filterNode interface {
+	gen(g *filterGen, accept filterLabel, reject filterLabel)
+}
+
+type filterAnd []filterNode
+
+type filterOr []filterNode
+
+type filterNot struct {
+	node filterNode
+}
+
+// filterTest loads a value and compares it to val
+type filterTest struct {
+	loads []bpf.Instruction
+	cond  bpf.JumpTest
+	val   uint32
+}
+
+func (n filterAnd) gen(g *filterGen, accept filterLabel, reject filterLabel) {
+	if len(n) == 0 {
+		g.jump(accept)
+		return
+	}
+	for _, node := range n[:len(n)-1] {
+		next := g.newLabel()
+		node.gen(g, next, reject)
+		g.place(next)
+	}
+	n[len(n)-1].gen(g, accept, reject)
+}
+
+func (n filterOr) gen(g *filterGen, accept filterLabel, reject filterLabel) {
+	for _, node := range n[:len(n)-1] {
+		next := g.newLabel()
+		node.gen(g, accept, next)
+		g.place(next)
+	}
+	n[len(n)-1].gen(g, accept, reject)
+}
+
+func (n filterNot) gen(g *filterGen, accept filterLabel, reject filterLabel) {
+	n.node.gen(g, reject, accept)
+}
+
+func (n filterTest) gen(g *filterGen, accept filterLabel, reject filterLabel) {
+	g.insns = append(g.insns, n.loads...)
+	g.refs = append(g.refs, filterRef{insn: len(g.insns), accept: accept, reject: reject})
+	g.insns = append(g.insns, bpf.JumpIf{Cond: n.cond, Val: n.val})
+}
+
+// filterGen emits the instructions, with jumps to labels resolved once
+// every label is placed. Labels are always placed after the jumps to them,
+// as classic BPF only jumps forward.
+type filterGen struct {
+	insns  []bpf.Instruction
+	labels []int
+	refs   []filterRef
+}
+
+type filterLabel int
+
+type filterRef struct {
+	insn   int
+	accept filterLabel
+	reject filterLabel
+	always bool
+}
+
+func (g *filterGen) newLabel() filterLabel {
+	g.labels = append(g.labels, -1)
+	return filterLabel(len(g.labels) - 1)
+}
+
+func (g *filterGen) place(label filterLabel) {
+	g.labels[label] = len(g.insns)
+}
+
+func (g *filterGen) jump(label filterLabel) {
+	g.refs = append(g.refs, filterRef{insn: len(g.insns), accept: label, always: true})
+	g.insns = append(g.insns, bpf.Jump{})
+}
+
+// resolve sets the offsets of the jumps. Conditional jumps skip at most 255
+// instructions: a label farther away is reached through a trampoline, an
+// unconditional jump inserted right after the conditional one.
+func (g *filterGen) resolve() error {
+	for i := 0; i < len(g.refs); i++ {
+		ref := g.refs[i]
+		if ref.always {
+			continue
+		}
+		if g.labels[ref.accept]-ref.insn-1 > 0xff {
+			g.trampoline(i, true)
+			i = -1
+		} else if g.labels[ref.reject]-ref.insn-1 > 0xff {
+			g.trampoline(i, false)
+			i = -1
+		}
+	}
+
+	for _, ref := range g.refs {
+		skip := func(label filterLabel) (uint32, error) {
+			skip := g.labels[label] - ref.insn - 1
+			if skip < 0 {
+				return 0, fmt.Errorf("backward jump to label %d", label)
+			}
+			return uint32(skip), nil
+		}
+		if ref.always {
+			skipAccept, err := skip(ref.accept)
+			if err != nil {
+				return err
+			}
+			g.insns[ref.insn] = bpf.Jump{Skip: skipAccept}
+			continue
+		}
+		skipAccept, err := skip(ref.accept)
+		if err != nil {
+			return err
+		}
+		skipReject, err := skip(ref.reject)
+		if err != nil {
+			return err
+		}
+		jump := g.insns[ref.insn].(bpf.JumpIf)
+		jump.SkipTrue, jump.SkipFalse = uint8(skipAccept), uint8(skipReject)
+		g.insns[ref.insn] = jump
+	}
+	return nil
+}
+
+// trampoline inserts an unconditional jump to the accept or reject label of
+// the i-th reference, right after its conditional jump, and points that
+// branch of the conditional jump to it. Nothing falls through to the
+// trampoline, as conditional jumps always jump.
+func (g *filterGen) trampoline(i int, accept bool) {
+	at := g.refs[i].insn + 1
+	g.insns = slices.Insert(g.insns, at, bpf.Instruction(bpf.Jump{}))
+	for label := range g.labels {
+		if g.labels[label] >= at {
+			g.labels[label]++
+		}
+	}
+	for r := range g.refs {
+		if g.refs[r].insn >= at {
+			g.refs[r].insn++
+		}
+	}
+
+	label := g.newLabel()
+	g.labels[label] = at
+	if accept {
+		g.refs = append(g.refs, filterRef{insn: at, accept: g.refs[i].accept, always: true})
+		g.refs[i].accept = label
+	} else {
+		g.refs = append(g.refs, filterRef{insn: at, accept: g.refs[i].reject, always: true})
+		g.refs[i].reject = label
+	}
+}
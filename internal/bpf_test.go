@@ -0,0 +1,199 @@
+package internal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// testPacket is a network layer packet, with the EtherType the kernel
+// reports for it
+type testPacket struct {
+	etherType uint32
+	data      []byte
+}
+
+// ipv4Packet builds an IPv4 packet with a transport header starting with
+// the ports. The header has optionWords words of options, and the fragment
+// offset is in 8 bytes units.
+func ipv4Packet(src string, dst string, proto byte, sport uint16, dport uint16, optionWords int, fragment uint16) testPacket {
+	header := make([]byte, 20+4*optionWords)
+	header[0] = 0x40 | byte(5+optionWords)
+	binary.BigEndian.PutUint16(header[6:], fragment&0x1fff)
+	header[8] = 64
+	header[9] = proto
+	copy(header[12:16], netip.MustParseAddr(src).AsSlice())
+	copy(header[16:20], netip.MustParseAddr(dst).AsSlice())
+	transport := make([]byte, 8)
+	binary.BigEndian.PutUint16(transport[0:], sport)
+	binary.BigEndian.PutUint16(transport[2:], dport)
+	data := append(header, transport...)
+	binary.BigEndian.PutUint16(data[2:], uint16(len(data)))
+	return testPacket{etherType: etherTypeIPv4, data: data}
+}
+
+func ipv6Packet(src string, dst string, proto byte, sport uint16, dport uint16) testPacket {
+	header := make([]byte, 40)
+	header[0] = 0x60
+	binary.BigEndian.PutUint16(header[4:], 8)
+	header[6] = proto
+	header[7] = 64
+	copy(header[8:24], netip.MustParseAddr(src).AsSlice())
+	copy(header[24:40], netip.MustParseAddr(dst).AsSlice())
+	transport := make([]byte, 8)
+	binary.BigEndian.PutUint16(transport[0:], sport)
+	binary.BigEndian.PutUint16(transport[2:], dport)
+	return testPacket{etherType: etherTypeIPv6, data: append(header, transport...)}
+}
+
+// runFilter runs a program in the x/net/bpf VM. The VM knows neither the
+// SKF_NET_OFF loads nor the protocol extension: they become loads from the
+// start of the packet and a constant.
+func runFilter(t *testing.T, program []unix.SockFilter, packet testPacket) bool {
+	t.Helper()
+	insns := make([]bpf.Instruction, len(program))
+	for i, raw := range program {
+		insn := bpf.RawInstruction{Op: raw.Code, Jt: raw.Jt, Jf: raw.Jf, K: raw.K}.Disassemble()
+		switch ins := insn.(type) {
+		case bpf.LoadAbsolute:
+			ins.Off -= skfNetOff
+			insn = ins
+		case bpf.LoadIndirect:
+			ins.Off -= skfNetOff
+			insn = ins
+		case bpf.LoadMemShift:
+			ins.Off -= skfNetOff
+			insn = ins
+		case bpf.LoadExtension:
+			if ins.Num != bpf.ExtProto {
+				t.Fatalf("unexpected extension %v", ins.Num)
+			}
+			insn = bpf.LoadConstant{Dst: bpf.RegA, Val: packet.etherType}
+		}
+		insns[i] = insn
+	}
+	vm, err := bpf.NewVM(insns)
+	if err != nil {
+		t.Fatalf("bpf.NewVM / %v", err)
+	}
+	n, err := vm.Run(packet.data)
+	if err != nil {
+		t.Fatalf("vm.Run / %v", err)
+	}
+	return n > 0
+}
+
+var (
+	udp4         = ipv4Packet("192.0.2.1", "10.0.0.1", protoUDP, 50000, 2456, 0, 0)
+	udp4Reply    = ipv4Packet("10.0.0.1", "192.0.2.1", protoUDP, 2456, 50000, 0, 0)
+	udp4Options  = ipv4Packet("192.0.2.1", "10.0.0.1", protoUDP, 50000, 2456, 2, 0)
+	udp4Fragment = ipv4Packet("192.0.2.1", "10.0.0.1", protoUDP, 50000, 2456, 0, 185)
+	udp4Other    = ipv4Packet("192.0.2.1", "10.0.0.1", protoUDP, 50000, 53, 0, 0)
+	tcp4         = ipv4Packet("192.0.2.1", "10.0.0.1", protoTCP, 50000, 2456, 0, 0)
+	icmp4        = ipv4Packet("192.0.2.1", "10.0.0.1", protoICMP, 0, 0, 0, 0)
+	udp6         = ipv6Packet("2001:db8::2", "2001:db8::1", protoUDP, 50000, 2456)
+	tcp6         = ipv6Packet("2001:db8::2", "2001:db8::1", protoTCP, 50000, 2456)
+	udp6Other    = ipv6Packet("2001:db8::2", "2001:db8::3", protoUDP, 50000, 53)
+	icmp6        = ipv6Packet("2001:db8::2", "2001:db8::1", protoICMPv6, 0, 0)
+)
+
+func TestCompileFilter(t *testing.T) {
+	packets := map[string]testPacket{
+		"udp4": udp4, "udp4Reply": udp4Reply, "udp4Options": udp4Options, "udp4Fragment": udp4Fragment,
+		"udp4Other": udp4Other, "tcp4": tcp4, "icmp4": icmp4,
+		"udp6": udp6, "tcp6": tcp6, "udp6Other": udp6Other, "icmp6": icmp6,
+	}
+	tests := []struct {
+		filter  string
+		matched []string
+	}{
+		{"", []string{"udp4", "udp4Reply", "udp4Options", "udp4Fragment", "udp4Other", "tcp4", "icmp4", "udp6", "tcp6", "udp6Other", "icmp6"}},
+		{"ip", []string{"udp4", "udp4Reply", "udp4Options", "udp4Fragment", "udp4Other", "tcp4", "icmp4"}},
+		{"ip6", []string{"udp6", "tcp6", "udp6Other", "icmp6"}},
+		{"udp", []string{"udp4", "udp4Reply", "udp4Options", "udp4Fragment", "udp4Other", "udp6", "udp6Other"}},
+		{"tcp", []string{"tcp4", "tcp6"}},
+		{"icmp", []string{"icmp4"}},
+		{"icmp6", []string{"icmp6"}},
+		// Fragments other than the first carry no port
+		{"udp port 2456", []string{"udp4", "udp4Reply", "udp4Options", "udp6"}},
+		{"udp dst port 2456", []string{"udp4", "udp4Options", "udp6"}},
+		{"src port 2456", []string{"udp4Reply"}},
+		{"port 2456", []string{"udp4", "udp4Reply", "udp4Options", "tcp4", "udp6", "tcp6"}},
+		{"ip6 and port 2456", []string{"udp6", "tcp6"}},
+		{"host 10.0.0.1", []string{"udp4", "udp4Reply", "udp4Options", "udp4Fragment", "udp4Other", "tcp4", "icmp4"}},
+		{"dst host 10.0.0.1 and udp", []string{"udp4", "udp4Options", "udp4Fragment", "udp4Other"}},
+		{"src host 10.0.0.1", []string{"udp4Reply"}},
+		{"src net 192.0.2.0/24", []string{"udp4", "udp4Options", "udp4Fragment", "udp4Other", "tcp4", "icmp4"}},
+		{"dst host 2001:db8::1", []string{"udp6", "tcp6", "icmp6"}},
+		{"net 2001:db8::/32 and not icmp6", []string{"udp6", "tcp6", "udp6Other"}},
+		{"not udp", []string{"tcp4", "icmp4", "tcp6", "icmp6"}},
+		{"! (udp or tcp)", []string{"icmp4", "icmp6"}},
+		{"udp and not port 53", []string{"udp4", "udp4Reply", "udp4Options", "udp4Fragment", "udp6"}},
+		{"tcp port 2456 || udp port 53", []string{"udp4Other", "tcp4", "tcp6", "udp6Other"}},
+		{"(dst host 10.0.0.1 or dst host 2001:db8::1) and (udp port 2456)", []string{"udp4", "udp4Options", "udp6"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			program, err := compileFilter(tt.filter)
+			if err != nil {
+				t.Fatalf("compileFilter / %v", err)
+			}
+			for name, packet := range packets {
+				want := false
+				for _, matched := range tt.matched {
+					want = want || matched == name
+				}
+				if got := runFilter(t, program, packet); got != want {
+					t.Errorf("%s matched = %v, want %v", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCompileFilterUnsupported(t *testing.T) {
+	for _, filter := range []string{"ether host 00:11:22:33:44:55", "udp port", "portrange 1-2", "(udp", "tcp host 10.0.0.1"} {
+		if _, err := compileFilter(filter); !errors.Is(err, errUnsupportedFilter) {
+			t.Errorf("compileFilter(%q) = %v, want errUnsupportedFilter", filter, err)
+		}
+	}
+}
+
+// TestCompileFilterLong checks that branches farther than a conditional jump
+// reaches go through trampolines, for hosts with many IPv6 addresses
+func TestCompileFilterLong(t *testing.T) {
+	hosts := []string{}
+	for i := 1; i <= 100; i++ {
+		hosts = append(hosts, fmt.Sprintf("dst host 2001:db8::%x", i))
+	}
+	filter := fmt.Sprintf("(%s) and udp port 2456", strings.Join(hosts, " or "))
+	program, err := compileFilter(filter)
+	if err != nil {
+		t.Fatalf("compileFilter / %v", err)
+	}
+	if len(program) <= 0xff || len(program) > unix.BPF_MAXINSNS {
+		t.Fatalf("program of %d instructions, want between 256 and %d", len(program), unix.BPF_MAXINSNS)
+	}
+
+	tests := []struct {
+		packet testPacket
+		want   bool
+	}{
+		{ipv6Packet("2001:db8::ffff", "2001:db8::1", protoUDP, 50000, 2456), true},
+		{ipv6Packet("2001:db8::ffff", "2001:db8::64", protoUDP, 50000, 2456), true},
+		{ipv6Packet("2001:db8::ffff", "2001:db8::64", protoUDP, 50000, 53), false},
+		{ipv6Packet("2001:db8::ffff", "2001:db8::65", protoUDP, 50000, 2456), false},
+		{udp4, false},
+	}
+	for _, tt := range tests {
+		if got := runFilter(t, program, tt.packet); got != tt.want {
+			t.Errorf("packet to %v matched = %v, want %v", netip.AddrFrom16([16]byte(tt.packet.data[24:40])), got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Header of pcap files with nanosecond timestamps. Packets are written from
+// their network header, as LINKTYPE_RAW, whatever the interface.
+const (
+	pcapMagic       = 0xa1b23c4d
+	pcapVersionMaj  = 2
+	pcapVersionMin  = 4
+	pcapLinkTypeRaw = 101
+)
+
+// pcapWriter writes a sample of packets to a pcap file, up to a number of
+// packets. The file is closed when the sample is complete.
+type pcapWriter struct {
+	mu    sync.Mutex
+	path  string
+	file  *os.File
+	count int
+	limit int
+	done  chan struct{}
+}
+
+func newPcapWriter(path string, limit int) (*pcapWriter, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("os.MkdirAll / %w", err)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("os.Create / %w", err)
+	}
+	header := binary.LittleEndian.AppendUint32(nil, pcapMagic)
+	header = binary.LittleEndian.AppendUint16(header, pcapVersionMaj)
+	header = binary.LittleEndian.AppendUint16(header, pcapVersionMin)
+	header = binary.LittleEndian.AppendUint32(header, 0) // thiszone
+	header = binary.LittleEndian.AppendUint32(header, 0) // sigfigs
+	header = binary.LittleEndian.AppendUint32(header, MTU)
+	header = binary.LittleEndian.AppendUint32(header, pcapLinkTypeRaw)
+	if _, err := file.Write(header); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Write / %w", err)
+	}
+	return &pcapWriter{path: path, file: file, limit: max(limit, 1), done: make(chan struct{})}, nil
+}
+
+// write adds a packet truncated from length bytes. Records are written in a
+// single call, so that the file stays readable if the wrapper is killed.
+func (p *pcapWriter) write(t time.Time, packet []byte, length int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.file == nil {
+		return
+	}
+	record := binary.LittleEndian.AppendUint32(nil, uint32(t.Unix()))
+	record = binary.LittleEndian.AppendUint32(record, uint32(t.Nanosecond()))
+	record = binary.LittleEndian.AppendUint32(record, uint32(len(packet)))
+	record = binary.LittleEndian.AppendUint32(record, uint32(max(length, len(packet))))
+	record = append(record, packet...)
+	if _, err := p.file.Write(record); err != nil {
+		p.closeFile()
+		return
+	}
+	p.count++
+	if p.count >= p.limit {
+		p.closeFile()
+	}
+}
+
+// full tells if the sample is complete
+func (p *pcapWriter) full() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.file == nil
+}
+
+// written return the number of packets written so far
+func (p *pcapWriter) written() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.count
+}
+
+func (p *pcapWriter) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closeFile()
+}
+
+// closeFile must be called with the lock
+func (p *pcapWriter) closeFile() {
+	if p.file == nil {
+		return
+	}
+	p.file.Close()
+	p.file = nil
+	close(p.done)
+}
+
+// unmatchedCapturePath return the path of the sample of unmatched packets,
+// next to the sample of matched ones: capture.pcap gives
+// capture-unmatched.pcap
+func unmatchedCapturePath(path string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-unmatched" + ext
+}
+
+// invertFilter return a filter accepting the packets rejected by filter, and
+// the other way around. Only constant returns can be inverted, which is what
+// both compilers emit.
+func invertFilter(filter []unix.SockFilter) ([]unix.SockFilter, error) {
+	inverted := make([]unix.SockFilter, len(filter))
+	for i, ins := range filter {
+		switch ins.Code {
+		case unix.BPF_RET | unix.BPF_K:
+			if ins.K == 0 {
+				ins.K = MTU
+			} else {
+				ins.K = 0
+			}
+		case unix.BPF_RET | unix.BPF_A:
+			return nil, fmt.Errorf("%w: cannot invert a return of the accumulator", errUnsupportedFilter)
+		}
+		inverted[i] = ins
+	}
+	return inverted, nil
+}
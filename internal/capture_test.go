@@ -0,0 +1,168 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// pcapRecord is a packet read back from a pcap file
+type pcapRecord struct {
+	t      time.Time
+	data   []byte
+	length int
+}
+
+// readPcap parses a pcap file written by pcapWriter
+func readPcap(t *testing.T, path string) []pcapRecord {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("os.ReadFile / %v", err)
+	}
+	if len(content) < 24 {
+		t.Fatalf("header of %d bytes", len(content))
+	}
+	header := []struct {
+		name string
+		got  uint32
+		want uint32
+	}{
+		{"magic", binary.LittleEndian.Uint32(content[0:]), pcapMagic},
+		{"version major", uint32(binary.LittleEndian.Uint16(content[4:])), pcapVersionMaj},
+		{"version minor", uint32(binary.LittleEndian.Uint16(content[6:])), pcapVersionMin},
+		{"snaplen", binary.LittleEndian.Uint32(content[16:]), MTU},
+		{"linktype", binary.LittleEndian.Uint32(content[20:]), pcapLinkTypeRaw},
+	}
+	for _, field := range header {
+		if field.got != field.want {
+			t.Errorf("%s = %#x, want %#x", field.name, field.got, field.want)
+		}
+	}
+
+	records := []pcapRecord{}
+	for rest := content[24:]; len(rest) > 0; {
+		if len(rest) < 16 {
+			t.Fatalf("record header of %d bytes", len(rest))
+		}
+		sec, nsec := binary.LittleEndian.Uint32(rest[0:]), binary.LittleEndian.Uint32(rest[4:])
+		captured, length := binary.LittleEndian.Uint32(rest[8:]), binary.LittleEndian.Uint32(rest[12:])
+		if uint32(len(rest)-16) < captured {
+			t.Fatalf("record of %d bytes, %d left", captured, len(rest)-16)
+		}
+		records = append(records, pcapRecord{
+			t:      time.Unix(int64(sec), int64(nsec)),
+			data:   rest[16 : 16+captured],
+			length: int(length),
+		})
+		rest = rest[16+captured:]
+	}
+	return records
+}
+
+func TestPcapWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture", "capture.pcap")
+	p, err := newPcapWriter(path, 3)
+	if err != nil {
+		t.Fatalf("newPcapWriter / %v", err)
+	}
+
+	start := time.Unix(1700000000, 123456789)
+	packets := [][]byte{udp4.data, udp6.data, tcp4.data, icmp4.data}
+	for i, packet := range packets {
+		// The last packet is beyond the limit
+		p.write(start.Add(time.Duration(i)*time.Millisecond), packet, len(packet)+100*i)
+	}
+	if !p.full() {
+		t.Error("not full after the limit")
+	}
+	if got := p.written(); got != 3 {
+		t.Errorf("written() = %d, want 3", got)
+	}
+	select {
+	case <-p.done:
+	default:
+		t.Error("done not closed when full")
+	}
+	p.close()
+
+	records := readPcap(t, path)
+	if len(records) != 3 {
+		t.Fatalf("%d records, want 3", len(records))
+	}
+	for i, record := range records {
+		if want := start.Add(time.Duration(i) * time.Millisecond); !record.t.Equal(want) {
+			t.Errorf("record %d at %v, want %v", i, record.t, want)
+		}
+		if !bytes.Equal(record.data, packets[i]) {
+			t.Errorf("record %d = %x, want %x", i, record.data, packets[i])
+		}
+		if want := len(packets[i]) + 100*i; record.length != want {
+			t.Errorf("record %d of length %d, want %d", i, record.length, want)
+		}
+	}
+}
+
+func TestPcapWriterClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.pcap")
+	p, err := newPcapWriter(path, 10)
+	if err != nil {
+		t.Fatalf("newPcapWriter / %v", err)
+	}
+	p.write(time.Now(), udp4.data, len(udp4.data))
+	p.close()
+	// Writes after close are dropped
+	p.write(time.Now(), udp6.data, len(udp6.data))
+	p.close()
+
+	if records := readPcap(t, path); len(records) != 1 {
+		t.Errorf("%d records, want 1", len(records))
+	}
+}
+
+func TestUnmatchedCapturePath(t *testing.T) {
+	tests := map[string]string{
+		"/tmp/capture.pcap": "/tmp/capture-unmatched.pcap",
+		"/tmp/capture":      "/tmp/capture-unmatched",
+		"/tmp/a.b/capture":  "/tmp/a.b/capture-unmatched",
+	}
+	for path, want := range tests {
+		if got := unmatchedCapturePath(path); got != want {
+			t.Errorf("unmatchedCapturePath(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestInvertFilter(t *testing.T) {
+	packets := []testPacket{udp4, udp4Reply, udp4Fragment, udp4Other, tcp4, icmp4, udp6, tcp6, udp6Other, icmp6}
+	for _, filter := range []string{"", "udp", "udp port 2456", "not tcp", "dst host 2001:db8::1 or src host 10.0.0.1"} {
+		t.Run(filter, func(t *testing.T) {
+			program, err := compileFilter(filter)
+			if err != nil {
+				t.Fatalf("compileFilter / %v", err)
+			}
+			inverted, err := invertFilter(program)
+			if err != nil {
+				t.Fatalf("invertFilter / %v", err)
+			}
+			for _, packet := range packets {
+				if runFilter(t, program, packet) == runFilter(t, inverted, packet) {
+					t.Errorf("packet %x matched by both or neither", packet.data)
+				}
+			}
+		})
+	}
+}
+
+func TestInvertFilterUnsupported(t *testing.T) {
+	filter := []unix.SockFilter{{Code: unix.BPF_RET | unix.BPF_A}}
+	if _, err := invertFilter(filter); !errors.Is(err, errUnsupportedFilter) {
+		t.Errorf("invertFilter = %v, want errUnsupportedFilter", err)
+	}
+}
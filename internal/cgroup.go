@@ -0,0 +1,158 @@
+package internal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const cgroupRoot = "/sys/fs/cgroup"
+
+// cgroupLimits are written as is in the cgroup v2 interface files, so they
+// follow the kernel format (e.g. "2G" or "max" for memory.max, "50000 100000"
+// for cpu.max). Empty limits are left untouched.
+type cgroupLimits struct {
+	MemoryMax  string
+	MemoryHigh string
+	CpuMax     string
+	PidsMax    string
+}
+
+func (l cgroupLimits) files() map[string]string {
+	return map[string]string{
+		"memory.max":  l.MemoryMax,
+		"memory.high": l.MemoryHigh,
+		"cpu.max":     l.CpuMax,
+		"pids.max":    l.PidsMax,
+	}
+}
+
+func (l cgroupLimits) controllers() []string {
+	controllers := []string{}
+	if l.MemoryMax != "" || l.MemoryHigh != "" {
+		controllers = append(controllers, "memory")
+	}
+	if l.CpuMax != "" {
+		controllers = append(controllers, "cpu")
+	}
+	if l.PidsMax != "" {
+		controllers = append(controllers, "pids")
+	}
+	return controllers
+}
+
+// ownCgroup return the cgroup v2 directory of the wrapper
+func ownCgroup() (string, error) {
+	content, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if path, found := strings.CutPrefix(line, "0::"); found {
+			return filepath.Join(cgroupRoot, path), nil
+		}
+	}
+	return "", errors.New("no cgroup v2 hierarchy in /proc/self/cgroup")
+}
+
+// setupProcessCgroup creates the leaf cgroup of the process, next to a leaf
+// cgroup for the wrapper, and applies the limits. The returned directory
+// is opened to be used as CLONE_INTO_CGROUP target.
+//
+// Processes are moved out of the parent because cgroup v2 forbids enabling
+// controllers for the children of a non-root cgroup that holds processes:
+//
+//	<own cgroup>/
+//	├── serverwrap/  (wrapper, and other processes of the parent)
+//	└── <name>/      (process, with limits)
+func setupProcessCgroup(name string, limits cgroupLimits) (*os.File, error) {
+	parent, err := ownCgroup()
+	if err != nil {
+		return nil, fmt.Errorf("ownCgroup / %w", err)
+	}
+
+	wrapperDir := filepath.Join(parent, "serverwrap")
+	if err := os.MkdirAll(wrapperDir, 0755); err != nil {
+		return nil, fmt.Errorf("os.MkdirAll / %w", err)
+	}
+	if err := moveCgroupProcs(parent, wrapperDir); err != nil {
+		return nil, fmt.Errorf("moveCgroupProcs / %w", err)
+	}
+
+	controllers := []string{}
+	for _, c := range limits.controllers() {
+		controllers = append(controllers, "+"+c)
+	}
+	if len(controllers) > 0 {
+		if err := os.WriteFile(filepath.Join(parent, "cgroup.subtree_control"), []byte(strings.Join(controllers, " ")), 0); err != nil {
+			return nil, fmt.Errorf("enable controllers %v / %w", controllers, err)
+		}
+	}
+
+	processDir := filepath.Join(parent, name)
+	if err := os.MkdirAll(processDir, 0755); err != nil {
+		return nil, fmt.Errorf("os.MkdirAll / %w", err)
+	}
+	for file, value := range limits.files() {
+		if value == "" {
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(processDir, file), []byte(value), 0); err != nil {
+			return nil, fmt.Errorf("write %v / %w", file, err)
+		}
+	}
+
+	return os.Open(processDir)
+}
+
+// moveCgroupProcs moves every process of the src cgroup to dst
+func moveCgroupProcs(src string, dst string) error {
+	content, err := os.ReadFile(filepath.Join(src, "cgroup.procs"))
+	if err != nil {
+		return err
+	}
+	for _, pid := range strings.Fields(string(content)) {
+		err := os.WriteFile(filepath.Join(dst, "cgroup.procs"), []byte(pid), 0)
+		// The process may have exited in between
+		if err != nil && !errors.Is(err, syscall.ESRCH) {
+			return fmt.Errorf("move %v / %w", pid, err)
+		}
+	}
+	return nil
+}
+
+// cgroupOomKills return the number of processes killed by the OOM killer in
+// the cgroup, from memory.events
+func cgroupOomKills(dir string) (int64, error) {
+	file, err := os.Open(filepath.Join(dir, "memory.events"))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			return strconv.ParseInt(fields[1], 10, 64)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, errors.New("oom_kill not found in memory.events")
+}
+
+// cgroupMemoryPeak return the peak memory usage of the cgroup, in bytes
+func cgroupMemoryPeak(dir string) (int64, error) {
+	content, err := os.ReadFile(filepath.Join(dir, "memory.peak"))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+}
@@ -0,0 +1,217 @@
+package internal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// DefaultConsoleSocket is the socket path used when LSDC2_CONSOLE_SOCKET is
+// not set
+const DefaultConsoleSocket = "/tmp/serverwrap-console.sock"
+
+// Number of lines buffered for each console client. Lines are dropped for
+// clients that do not keep up, so that a slow client never blocks the scans.
+const consoleClientBuffer = 256
+
+// console exposes the process output and stdin on a Unix socket. Every
+// client receives the output; only one client at a time may write, the
+// first one that sends a line.
+type console struct {
+	logger   *zap.Logger
+	stdin    io.WriteCloser
+	listener net.Listener
+	path     string
+
+	mu      sync.Mutex
+	clients map[*consoleClient]bool
+	writer  *consoleClient
+}
+
+type consoleClient struct {
+	conn  net.Conn
+	lines chan string
+}
+
+func newConsole(logger *zap.Logger, path string, stdin io.WriteCloser) (*console, error) {
+	// A stale socket remains if the previous wrapper did not exit cleanly
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("os.Remove / %w", err)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("net.Listen / %w", err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("os.Chmod / %w", err)
+	}
+
+	c := &console{
+		logger:   logger,
+		stdin:    stdin,
+		listener: listener,
+		path:     path,
+		clients:  map[*consoleClient]bool{},
+	}
+	go c.accept()
+	return c, nil
+}
+
+func (c *console) accept() {
+	for {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				c.logger.Error("error in console", zap.String("culprit", "Accept"), zap.Error(err))
+			}
+			return
+		}
+		client := &consoleClient{conn: conn, lines: make(chan string, consoleClientBuffer)}
+		c.mu.Lock()
+		c.clients[client] = true
+		c.mu.Unlock()
+		c.logger.Info("console client connected")
+
+		go c.send(client)
+		go c.receive(client)
+	}
+}
+
+// send streams the output lines to the client until it disconnects
+func (c *console) send(client *consoleClient) {
+	for line := range client.lines {
+		if _, err := fmt.Fprintln(client.conn, line); err != nil {
+			c.disconnect(client)
+			return
+		}
+	}
+}
+
+// receive writes the client input to the process stdin, if the client is
+// the writer. The session ends when the client input ends.
+func (c *console) receive(client *consoleClient) {
+	defer c.disconnect(client)
+
+	reader := bufio.NewReader(client.conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if len(line) > 0 {
+			if !c.claimWriter(client) {
+				fmt.Fprintln(client.conn, "[serverwrap] console is used by another writer, input ignored")
+			} else if err := c.write(line); err != nil {
+				c.logger.Error("error in console", zap.String("culprit", "WriteString"), zap.Error(err))
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// setStdin replaces the stdin of the process, when it is restarted
+func (c *console) setStdin(stdin io.WriteCloser) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stdin.Close()
+	c.stdin = stdin
+}
+
+func (c *console) claimWriter(client *consoleClient) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.writer == nil {
+		c.writer = client
+		c.logger.Info("console writer attached")
+	}
+	return c.writer == client
+}
+
+func (c *console) write(line string) error {
+	c.mu.Lock()
+	stdin := c.stdin
+	c.mu.Unlock()
+	_, err := io.WriteString(stdin, line)
+	return err
+}
+
+func (c *console) disconnect(client *consoleClient) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.clients[client] {
+		return
+	}
+	delete(c.clients, client)
+	if c.writer == client {
+		c.writer = nil
+	}
+	close(client.lines)
+	client.conn.Close()
+	c.logger.Info("console client disconnected")
+}
+
+// broadcast sends a line of output to every client, without blocking
+func (c *console) broadcast(line string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for client := range c.clients {
+		select {
+		case client.lines <- line:
+		default:
+		}
+	}
+}
+
+func (c *console) close() {
+	c.listener.Close()
+	c.mu.Lock()
+	clients := []*consoleClient{}
+	for client := range c.clients {
+		clients = append(clients, client)
+	}
+	c.mu.Unlock()
+	for _, client := range clients {
+		c.disconnect(client)
+	}
+	c.mu.Lock()
+	c.stdin.Close()
+	c.mu.Unlock()
+	os.Remove(c.path)
+}
+
+// RunConsoleClient attaches the terminal to the console socket: the output
+// of the process is printed and the lines typed are sent to the process
+func RunConsoleClient(path string) error {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return fmt.Errorf("net.Dial / %w", err)
+	}
+	defer conn.Close()
+
+	outputDone := make(chan struct{})
+	go func() {
+		io.Copy(os.Stdout, conn)
+		close(outputDone)
+	}()
+
+	inputDone := make(chan struct{})
+	go func() {
+		io.Copy(conn, os.Stdin)
+		conn.(*net.UnixConn).CloseWrite()
+		close(inputDone)
+	}()
+
+	select {
+	case <-outputDone:
+	case <-inputDone:
+		<-outputDone
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// crashReport describes how the process ended, for the crash bundle
+type crashReport struct {
+	Server           string
+	ExitCode         int
+	Signal           string `json:",omitempty"`
+	CoreDumped       bool
+	StartedAt        time.Time
+	ExitedAt         time.Time
+	Uptime           string
+	MaxRssKiB        int64
+	FreeMemoryMiB    int64
+	CgroupMemoryPeak int64 `json:",omitempty"`
+	OomKilled        bool
+}
+
+func newCrashReport(server string, state *os.ProcessState, startedAt time.Time, exitedAt time.Time) crashReport {
+	report := crashReport{
+		Server:    server,
+		ExitCode:  processExitCode(state),
+		StartedAt: startedAt,
+		ExitedAt:  exitedAt,
+		Uptime:    exitedAt.Sub(startedAt).Round(time.Second).String(),
+	}
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		report.Signal = status.Signal().String()
+		report.CoreDumped = status.CoreDump()
+	}
+	if rusage, ok := state.SysUsage().(*syscall.Rusage); ok {
+		report.MaxRssKiB = rusage.Maxrss
+	}
+	return report
+}
+
+// findCoreFile looks for a core dump of pid in dir, named after the default
+// core_pattern ("core" or "core.<pid>"). Core files older than since are
+// left over by previous sessions and ignored.
+func findCoreFile(dir string, pid int, since time.Time) string {
+	for _, name := range []string{"core." + strconv.Itoa(pid), "core"} {
+		path := filepath.Join(dir, name)
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() && !info.ModTime().Before(since) {
+			return path
+		}
+	}
+	return ""
+}
+
+// writeCrashBundle writes a zip with the report, the last output lines and
+// the core file, if any
+func writeCrashBundle(w io.Writer, report crashReport, lines []string, corePath string) error {
+	zw := zip.NewWriter(w)
+
+	reportW, err := zw.Create("report.json")
+	if err != nil {
+		return fmt.Errorf("zip.Create / %w", err)
+	}
+	encoder := json.NewEncoder(reportW)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return fmt.Errorf("json.Encode / %w", err)
+	}
+
+	outputW, err := zw.Create("output.log")
+	if err != nil {
+		return fmt.Errorf("zip.Create / %w", err)
+	}
+	if _, err := io.WriteString(outputW, strings.Join(lines, "\n")+"\n"); err != nil {
+		return fmt.Errorf("io.WriteString / %w", err)
+	}
+
+	if corePath != "" {
+		if err := zipCoreFile(zw, corePath); err != nil {
+			return fmt.Errorf("zipCoreFile / %w", err)
+		}
+	}
+
+	return zw.Close()
+}
+
+func zipCoreFile(zw *zip.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	coreW, err := zw.CreateHeader(&zip.FileHeader{Name: filepath.Base(path), Method: zip.Deflate})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(coreW, f)
+	return err
+}
+
+// uploadCrashBundle streams the crash bundle to S3, without holding it in
+// memory since core files can be large
+func uploadCrashBundle(bucket string, key string, report crashReport, lines []string, corePath string) error {
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(writeCrashBundle(w, report, lines, corePath))
+	}()
+	err := streamUploadToS3(bucket, key, r)
+	// Unblock the writer if the upload stopped early
+	r.CloseWithError(errors.New("upload ended"))
+	return err
+}
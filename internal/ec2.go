@@ -10,6 +10,7 @@ import (
 const TokenEndpoint = "http://169.254.169.254/latest/api/token"
 const InstanceIdEndpoint = "http://169.254.169.254/latest/meta-data/instance-id"
 const SpotTerminationEndpoint = "http://169.254.169.254/latest/meta-data/spot/termination-time"
+const PublicIpEndpoint = "http://169.254.169.254/latest/meta-data/public-ipv4"
 
 var __token string
 
@@ -35,6 +36,25 @@ func GetInstanceId() (string, error) {
 	return string(instanceId), nil
 }
 
+func GetPublicIp() (string, error) {
+	resp, err := getWithToken(PublicIpEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("getWithToken / %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to get public-ipv4 / %d", resp.StatusCode)
+	}
+
+	publicIp, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("error reading public-ipv4 / %w", err)
+	}
+
+	return string(publicIp), nil
+}
+
 func SpotTerminationIsNotified() (bool, error) {
 	resp, err := getWithToken(SpotTerminationEndpoint)
 	if err != nil {
@@ -99,7 +119,7 @@ func getImdsv2Token() (string, error) {
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("failed to get token / %s", resp.StatusCode)
+		return "", fmt.Errorf("failed to get token / %d", resp.StatusCode)
 	}
 
 	token, err := io.ReadAll(resp.Body)
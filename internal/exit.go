@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"os"
+	"syscall"
+)
+
+// StopReason tells why the wrapper ended the session
+type StopReason int
+
+const (
+	StopProcessExited StopReason = iota
+	StopEmpty
+	StopSpotTermination
+	StopLowMemory
+	StopSignal
+	StopRule
+	StopNotReady
+	StopHang
+)
+
+// Exit codes of the wrapper when it initiated the stop. When the process
+// exited on its own, the wrapper exits with the process exit code, or
+// 128+signal if it was killed by a signal.
+const (
+	ExitCodeEmpty           = 80
+	ExitCodeSpotTermination = 81
+	ExitCodeLowMemory       = 82
+	ExitCodeSignal          = 83
+	ExitCodeRule            = 84
+	ExitCodeNotReady        = 85
+	ExitCodeHang            = 86
+	ExitCodeUnknown         = 1
+)
+
+func (r StopReason) String() string {
+	switch r {
+	case StopProcessExited:
+		return "process-exited"
+	case StopEmpty:
+		return "empty"
+	case StopSpotTermination:
+		return "spot-termination"
+	case StopLowMemory:
+		return "low-memory"
+	case StopSignal:
+		return "signal"
+	case StopRule:
+		return "rule"
+	case StopNotReady:
+		return "not-ready"
+	case StopHang:
+		return "hang"
+	}
+	return "unknown"
+}
+
+// ExitCode return the wrapper exit code for a given stop reason. The process
+// state is only used when the process exited on its own.
+func (r StopReason) ExitCode(state *os.ProcessState) int {
+	switch r {
+	case StopProcessExited:
+		return processExitCode(state)
+	case StopEmpty:
+		return ExitCodeEmpty
+	case StopSpotTermination:
+		return ExitCodeSpotTermination
+	case StopLowMemory:
+		return ExitCodeLowMemory
+	case StopSignal:
+		return ExitCodeSignal
+	case StopRule:
+		return ExitCodeRule
+	case StopNotReady:
+		return ExitCodeNotReady
+	case StopHang:
+		return ExitCodeHang
+	}
+	return ExitCodeUnknown
+}
+
+func processExitCode(state *os.ProcessState) int {
+	if state == nil {
+		return ExitCodeUnknown
+	}
+	if status, ok := state.Sys().(syscall.WaitStatus); ok {
+		return waitStatusExitCode(status)
+	}
+	return state.ExitCode()
+}
+
+// waitStatusExitCode return the exit code of a process, or 128+signal if it
+// was killed by a signal
+func waitStatusExitCode(status syscall.WaitStatus) int {
+	if status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return status.ExitStatus()
+}
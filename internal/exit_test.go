@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"os/exec"
+	"syscall"
+	"testing"
+)
+
+func TestStopReasonExitCode(t *testing.T) {
+	tests := []struct {
+		reason StopReason
+		want   int
+	}{
+		{StopEmpty, 80},
+		{StopSpotTermination, 81},
+		{StopLowMemory, 82},
+		{StopSignal, 83},
+		{StopRule, 84},
+		{StopNotReady, 85},
+		{StopHang, 86},
+		{StopProcessExited, ExitCodeUnknown},
+		{StopReason(99), ExitCodeUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.reason.String(), func(t *testing.T) {
+			if got := tt.reason.ExitCode(nil); got != tt.want {
+				t.Errorf("ExitCode() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWaitStatusExitCode(t *testing.T) {
+	// Linux encodes the exit code in the second byte, and the signal of a
+	// killed process in the low 7 bits
+	tests := []struct {
+		name   string
+		status syscall.WaitStatus
+		want   int
+	}{
+		{"success", 0, 0},
+		{"exit 1", 1 << 8, 1},
+		{"exit 42", 42 << 8, 42},
+		{"SIGTERM", syscall.WaitStatus(syscall.SIGTERM), 143},
+		{"SIGKILL", syscall.WaitStatus(syscall.SIGKILL), 137},
+		{"SIGSEGV with core", syscall.WaitStatus(syscall.SIGSEGV) | 0x80, 139},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := waitStatusExitCode(tt.status); got != tt.want {
+				t.Errorf("waitStatusExitCode(%#x) = %d, want %d", uint32(tt.status), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessExitCode(t *testing.T) {
+	tests := []struct {
+		script string
+		want   int
+	}{
+		{"exit 0", 0},
+		{"exit 3", 3},
+		{"kill -KILL $$", 137},
+	}
+	for _, tt := range tests {
+		t.Run(tt.script, func(t *testing.T) {
+			cmd := exec.Command("sh", "-c", tt.script)
+			cmd.Run()
+			if got := StopProcessExited.ExitCode(cmd.ProcessState); got != tt.want {
+				t.Errorf("ExitCode() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Lifecycle phases at which a hook can be run
+const (
+	PhaseAfterRestore   = "after-restore"
+	PhaseBeforeStart    = "before-start"
+	PhaseOnReady        = "on-ready"
+	PhaseBeforeSave     = "before-save"
+	PhaseAfterSave      = "after-save"
+	PhaseBeforeShutdown = "before-shutdown"
+)
+
+// A hook exiting with this code vetoes its phase, e.g. the save is skipped
+// for before-save. Any other non-zero exit code is a failure.
+const HookVetoExitCode = 3
+
+// Delay given to a killed hook for its output to close. Children it left in
+// the background may hold its stdout open.
+const hookWaitDelay = 5 * time.Second
+
+var ErrHookVeto = errors.New("vetoed by hook")
+
+// hookContext is the JSON document sent on the hook stdin
+type hookContext struct {
+	Server       string
+	Phase        string
+	Home         string
+	Bucket       string
+	ZipFrom      string
+	PersistFiles []string
+	Players      []string `json:",omitempty"`
+	StopReason   string   `json:",omitempty"`
+	ExitCode     *int     `json:",omitempty"`
+}
+
+func (w *Wrapped) hookPath(phase string) string {
+	switch phase {
+	case PhaseAfterRestore:
+		return w.HookAfterRestore
+	case PhaseBeforeStart:
+		return w.HookBeforeStart
+	case PhaseOnReady:
+		return w.HookOnReady
+	case PhaseBeforeSave:
+		return w.HookBeforeSave
+	case PhaseAfterSave:
+		return w.HookAfterSave
+	case PhaseBeforeShutdown:
+		return w.HookBeforeShutdown
+	}
+	return ""
+}
+
+// runHook runs the hook configured for the phase, if any. Return ErrHookVeto
+// if the hook vetoed the phase, or an error if it failed or timed out.
+func (w *Wrapped) runHook(phase string) error {
+	path := w.hookPath(phase)
+	if path == "" {
+		return nil
+	}
+
+	hookCtx := hookContext{
+		Server:       w.Server,
+		Phase:        phase,
+		Home:         w.Home,
+		Bucket:       w.Bucket,
+		ZipFrom:      w.ZipFrom,
+		PersistFiles: w.PersistFiles,
+	}
+	if w.TracksPlayers() {
+		hookCtx.Players = w.players.names()
+	}
+	if reason, stopping := w.stopState(); stopping {
+		hookCtx.StopReason = reason.String()
+	}
+	run := w.currentRun()
+	select {
+	case <-run.exited:
+		exitCode := processExitCode(run.cmd.ProcessState)
+		hookCtx.ExitCode = &exitCode
+	default:
+	}
+	input, err := json.Marshal(hookCtx)
+	if err != nil {
+		return fmt.Errorf("json.Marshal / %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), w.HookTimeout)
+	defer cancel()
+
+	output := bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	cmd.Dir = w.Home
+	// The hook leads its own process group, so that the timeout kills the
+	// children it started too
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = hookWaitDelay
+
+	w.logger.Info("running hook", zap.String("phase", phase), zap.String("hook", path))
+	start := time.Now()
+	err = w.reaper.runManaged(cmd)
+
+	scanner := bufio.NewScanner(&output)
+	for scanner.Scan() {
+		w.logger.Info(scanner.Text(), zap.String("phase", phase))
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("hook %v timed out after %v", path, w.HookTimeout)
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == HookVetoExitCode {
+		return ErrHookVeto
+	}
+	if err != nil {
+		return fmt.Errorf("hook %v / %w", path, err)
+	}
+	w.logger.Debug("hook done", zap.String("phase", phase), zap.Duration("duration", time.Since(start)))
+	return nil
+}
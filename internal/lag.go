@@ -0,0 +1,83 @@
+package internal
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Lines logged by games when their tick falls behind
+var builtinLagPatterns = []string{
+	`Can't keep up! Is the server overloaded\?`,
+	`Running \d+ms or \d+ ticks behind`,
+	`(?i)\bserver (is )?overloaded\b`,
+}
+
+// lagDetector counts the lag lines over a sliding window, and tells when
+// the count reaches the threshold, at most once per warning interval
+type lagDetector struct {
+	patterns     []*regexp.Regexp
+	window       time.Duration
+	threshold    int
+	warnInterval time.Duration
+
+	mu       sync.Mutex
+	events   []time.Time
+	total    int64
+	lastWarn time.Time
+}
+
+func newLagDetector(builtin bool, patterns []string, window time.Duration, threshold int, warnInterval time.Duration) (*lagDetector, error) {
+	if builtin {
+		patterns = append(append([]string{}, builtinLagPatterns...), patterns...)
+	}
+	d := &lagDetector{
+		window:       window,
+		threshold:    threshold,
+		warnInterval: warnInterval,
+	}
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("regexp.Compile %q / %w", pattern, err)
+		}
+		d.patterns = append(d.patterns, re)
+	}
+	return d, nil
+}
+
+func (d *lagDetector) match(line string) bool {
+	for _, re := range d.patterns {
+		if re.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// record counts a lag line seen at t. Return the count in the window, the
+// total count, and whether a warning is due.
+func (d *lagDetector) record(t time.Time) (int, int64, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.total++
+	d.events = append(d.events, t)
+	start := 0
+	for start < len(d.events) && t.Sub(d.events[start]) > d.window {
+		start++
+	}
+	d.events = d.events[start:]
+
+	warn := len(d.events) >= d.threshold && (d.lastWarn.IsZero() || t.Sub(d.lastWarn) >= d.warnInterval)
+	if warn {
+		d.lastWarn = t
+	}
+	return len(d.events), d.total, warn
+}
+
+func (d *lagDetector) count() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.total
+}
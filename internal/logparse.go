@@ -0,0 +1,198 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Formats of the scanned lines, for LSDC2_LOG_FORMAT
+const (
+	LogFormatText   = "text"
+	LogFormatJson   = "json"
+	LogFormatLogfmt = "logfmt"
+)
+
+// Keys commonly used by logging libraries for the level, the message and
+// the time of an entry. Time keys are dropped, zap timestamps the entry.
+var (
+	levelKeys   = []string{"level", "lvl", "severity", "@l"}
+	messageKeys = []string{"msg", "message", "@m", "@mt"}
+	timeKeys    = []string{"time", "ts", "timestamp", "@t"}
+)
+
+// structuredLine is a scanned line parsed into a level, a message and
+// fields
+type structuredLine struct {
+	level  zapcore.Level
+	msg    string
+	fields map[string]any
+}
+
+// parseLogLine parses a line in the given format. Return false if the line
+// is not in that format, e.g. a stack trace among JSON lines.
+func parseLogLine(format string, line string) (structuredLine, bool) {
+	var fields map[string]any
+	switch format {
+	case LogFormatJson:
+		if !strings.HasPrefix(line, "{") || json.Unmarshal([]byte(line), &fields) != nil {
+			return structuredLine{}, false
+		}
+	case LogFormatLogfmt:
+		var ok bool
+		if fields, ok = parseLogfmt(line); !ok {
+			return structuredLine{}, false
+		}
+	default:
+		return structuredLine{}, false
+	}
+
+	parsed := structuredLine{level: zapcore.InfoLevel, msg: line}
+	if value, ok := popKey(fields, levelKeys); ok {
+		parsed.level = parseGameLevel(fmt.Sprint(value))
+	}
+	if value, ok := popKey(fields, messageKeys); ok {
+		parsed.msg = fmt.Sprint(value)
+	}
+	popKey(fields, timeKeys)
+	parsed.fields = fields
+	return parsed, true
+}
+
+// popKey removes and return the value of the first key of keys in fields
+func popKey(fields map[string]any, keys []string) (any, bool) {
+	for _, key := range keys {
+		if value, ok := fields[key]; ok {
+			delete(fields, key)
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+// parseGameLevel maps the level of a game entry to a zap level. Levels
+// above error are mapped to error, as zap panics or exits on them.
+func parseGameLevel(level string) zapcore.Level {
+	if n, err := strconv.Atoi(level); err == nil {
+		return parseNumericLevel(n)
+	}
+	switch strings.ToLower(level) {
+	case "trace", "verbose", "debug", "dbg":
+		return zapcore.DebugLevel
+	case "warn", "warning", "wrn":
+		return zapcore.WarnLevel
+	case "error", "err", "eror", "fatal", "critical", "crit", "panic":
+		return zapcore.ErrorLevel
+	}
+	return zapcore.InfoLevel
+}
+
+// parseNumericLevel maps a numeric level to a zap level: the syslog
+// severities from 0 (emergency) to 7 (debug), and the pino and bunyan levels
+// from 10 (trace) to 60 (fatal)
+func parseNumericLevel(level int) zapcore.Level {
+	switch {
+	case level < 0:
+		return zapcore.InfoLevel
+	case level <= 3:
+		return zapcore.ErrorLevel
+	case level == 4:
+		return zapcore.WarnLevel
+	case level <= 6:
+		return zapcore.InfoLevel
+	case level < 30:
+		return zapcore.DebugLevel
+	case level < 40:
+		return zapcore.InfoLevel
+	case level < 50:
+		return zapcore.WarnLevel
+	}
+	return zapcore.ErrorLevel
+}
+
+// zapFields return the fields sorted by key, under a "game" namespace so
+// that they cannot clash with the keys of the wrapper entries
+func (l structuredLine) zapFields() []zap.Field {
+	if len(l.fields) == 0 {
+		return nil
+	}
+	keys := []string{}
+	for key := range l.fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fields := []zap.Field{zap.Namespace("game")}
+	for _, key := range keys {
+		fields = append(fields, zap.Any(key, l.fields[key]))
+	}
+	return fields
+}
+
+// parseLogfmt parses key=value pairs, where values may be double quoted.
+// Return false if the line has no pair, or a malformed one.
+func parseLogfmt(line string) (map[string]any, bool) {
+	fields := map[string]any{}
+	i := 0
+	for i < len(line) {
+		for i < len(line) && line[i] == ' ' {
+			i++
+		}
+		if i == len(line) {
+			break
+		}
+
+		start := i
+		for i < len(line) && line[i] != '=' && line[i] != ' ' {
+			i++
+		}
+		key := line[start:i]
+		if key == "" || i == len(line) || line[i] != '=' {
+			return nil, false
+		}
+		i++
+
+		var value string
+		if i < len(line) && line[i] == '"' {
+			end := i + 1
+			for end < len(line) && line[end] != '"' {
+				if line[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(line) {
+				return nil, false
+			}
+			unquoted := ""
+			if err := json.Unmarshal([]byte(line[i:end+1]), &unquoted); err != nil {
+				return nil, false
+			}
+			value = unquoted
+			i = end + 1
+		} else {
+			start = i
+			for i < len(line) && line[i] != ' ' {
+				i++
+			}
+			value = line[start:i]
+		}
+		fields[key] = value
+	}
+	return fields, len(fields) > 0
+}
+
+// logLine logs a scanned line, as a structured entry keeping the level of the
+// game if the line is in the given format
+func logLine(logger *zap.Logger, format string, line string) {
+	if parsed, ok := parseLogLine(format, line); ok {
+		logger.Log(parsed.level, parsed.msg, parsed.zapFields()...)
+		return
+	}
+	logger.Info(line)
+}
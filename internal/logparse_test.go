@@ -0,0 +1,74 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+
+	"go.uber.org/zap/zapcore"
+)
+
+func TestParseLogLine(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		line   string
+		want   structuredLine
+		ok     bool
+	}{
+		{"json", LogFormatJson, `{"level":"warn","msg":"Can't keep up!","tick":1200,"time":"2024-01-01T00:00:00Z"}`,
+			structuredLine{level: zapcore.WarnLevel, msg: "Can't keep up!", fields: map[string]any{"tick": 1200.0}}, true},
+		{"json pino level", LogFormatJson, `{"level":50,"msg":"boom","pid":12}`,
+			structuredLine{level: zapcore.ErrorLevel, msg: "boom", fields: map[string]any{"pid": 12.0}}, true},
+		{"json severity", LogFormatJson, `{"severity":"CRITICAL","message":"disk full"}`,
+			structuredLine{level: zapcore.ErrorLevel, msg: "disk full", fields: map[string]any{}}, true},
+		// Without a level or a message, the entry is info and the line
+		{"json no level", LogFormatJson, `{"event":"join"}`,
+			structuredLine{level: zapcore.InfoLevel, msg: `{"event":"join"}`, fields: map[string]any{"event": "join"}}, true},
+		{"json malformed", LogFormatJson, `{"level":"warn"`, structuredLine{}, false},
+		{"json stack trace", LogFormatJson, `    at Server.tick (server.js:12)`, structuredLine{}, false},
+		{"logfmt", LogFormatLogfmt, `ts=2024-01-01T00:00:00Z lvl=error msg="save failed" path="/data/world 1" code=5`,
+			structuredLine{level: zapcore.ErrorLevel, msg: "save failed", fields: map[string]any{"path": "/data/world 1", "code": "5"}}, true},
+		{"logfmt escaped quote", LogFormatLogfmt, `level=info msg="say \"hi\"" empty=`,
+			structuredLine{level: zapcore.InfoLevel, msg: `say "hi"`, fields: map[string]any{"empty": ""}}, true},
+		{"logfmt bunyan level", LogFormatLogfmt, `level=40 msg=slow`,
+			structuredLine{level: zapcore.WarnLevel, msg: "slow", fields: map[string]any{}}, true},
+		{"logfmt no level", LogFormatLogfmt, `player=alice action=join`,
+			structuredLine{level: zapcore.InfoLevel, msg: `player=alice action=join`, fields: map[string]any{"player": "alice", "action": "join"}}, true},
+		{"logfmt plain text", LogFormatLogfmt, `Server started on port 2456`, structuredLine{}, false},
+		{"logfmt unterminated quote", LogFormatLogfmt, `msg="unterminated`, structuredLine{}, false},
+		{"logfmt missing key", LogFormatLogfmt, `=value`, structuredLine{}, false},
+		{"logfmt empty", LogFormatLogfmt, ``, structuredLine{}, false},
+		{"text", LogFormatText, `level=info msg=hello`, structuredLine{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseLogLine(tt.format, tt.line)
+			if ok != tt.ok {
+				t.Fatalf("parseLogLine ok = %v, want %v", ok, tt.ok)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseLogLine = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseGameLevel(t *testing.T) {
+	tests := map[string]zapcore.Level{
+		"debug": zapcore.DebugLevel, "TRACE": zapcore.DebugLevel, "info": zapcore.InfoLevel,
+		"Warning": zapcore.WarnLevel, "error": zapcore.ErrorLevel, "fatal": zapcore.ErrorLevel,
+		"notice": zapcore.InfoLevel, "": zapcore.InfoLevel,
+		// pino and bunyan
+		"10": zapcore.DebugLevel, "20": zapcore.DebugLevel, "30": zapcore.InfoLevel,
+		"40": zapcore.WarnLevel, "50": zapcore.ErrorLevel, "60": zapcore.ErrorLevel,
+		// syslog
+		"0": zapcore.ErrorLevel, "3": zapcore.ErrorLevel, "4": zapcore.WarnLevel,
+		"6": zapcore.InfoLevel, "7": zapcore.DebugLevel,
+		"-1": zapcore.InfoLevel,
+	}
+	for level, want := range tests {
+		if got := parseGameLevel(level); got != want {
+			t.Errorf("parseGameLevel(%q) = %v, want %v", level, got, want)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+var signalsByName = map[string]syscall.Signal{
+	"SIGHUP":   syscall.SIGHUP,
+	"SIGINT":   syscall.SIGINT,
+	"SIGQUIT":  syscall.SIGQUIT,
+	"SIGTERM":  syscall.SIGTERM,
+	"SIGUSR1":  syscall.SIGUSR1,
+	"SIGUSR2":  syscall.SIGUSR2,
+	"SIGWINCH": syscall.SIGWINCH,
+	"SIGCONT":  syscall.SIGCONT,
+}
+
+// parseSignal accepts signal names with or without the SIG prefix, in
+// any case (e.g. "SIGHUP", "hup")
+func parseSignal(name string) (syscall.Signal, error) {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	sig, ok := signalsByName[name]
+	if !ok {
+		return 0, fmt.Errorf("unsupported signal %v", name)
+	}
+	return sig, nil
+}
+
+// parseForwardSignals parses entries like "SIGHUP" (forwarded as is) or
+// "SIGINT:SIGTERM" (received SIGINT, forwarded as SIGTERM)
+func parseForwardSignals(entries []string) (map[os.Signal]os.Signal, error) {
+	forwarded := map[os.Signal]os.Signal{}
+	for _, entry := range entries {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		received, sent, found := strings.Cut(entry, ":")
+		recvSig, err := parseSignal(received)
+		if err != nil {
+			return nil, err
+		}
+		sentSig := recvSig
+		if found {
+			sentSig, err = parseSignal(sent)
+			if err != nil {
+				return nil, err
+			}
+		}
+		forwarded[recvSig] = sentSig
+	}
+	return forwarded, nil
+}
+
+// reaper collects zombie children that nobody waits for. Processes started
+// by the wrapper itself must go through startManaged so that a reaping pass
+// does not steal their exit status from exec.Cmd.Wait.
+type reaper struct {
+	mu      sync.Mutex
+	managed map[int]bool
+}
+
+func newReaper() *reaper {
+	return &reaper{managed: map[int]bool{}}
+}
+
+func (r *reaper) startManaged(cmd *exec.Cmd) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	r.managed[cmd.Process.Pid] = true
+	return nil
+}
+
+func (r *reaper) release(pid int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.managed, pid)
+}
+
+func (r *reaper) runManaged(cmd *exec.Cmd) error {
+	if err := r.startManaged(cmd); err != nil {
+		return err
+	}
+	defer r.release(cmd.Process.Pid)
+	return cmd.Wait()
+}
+
+// reapZombies waits for every zombie child that is not managed, and return
+// their pids
+func (r *reaper) reapZombies() ([]int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	zombies, err := listZombieChildren(os.Getpid())
+	if err != nil {
+		return nil, fmt.Errorf("listZombieChildren / %w", err)
+	}
+
+	reaped := []int{}
+	for _, pid := range zombies {
+		if r.managed[pid] {
+			continue
+		}
+		var status syscall.WaitStatus
+		wpid, err := syscall.Wait4(pid, &status, syscall.WNOHANG, nil)
+		if err != nil && err != syscall.ECHILD {
+			return reaped, fmt.Errorf("syscall.Wait4 / %w", err)
+		}
+		if wpid > 0 {
+			reaped = append(reaped, wpid)
+		}
+	}
+	return reaped, nil
+}
+
+// listZombieChildren scans /proc for processes in the zombie state whose
+// parent is ppid
+func listZombieChildren(ppid int) ([]int, error) {
+	stats, err := filepath.Glob("/proc/[0-9]*/stat")
+	if err != nil {
+		return nil, err
+	}
+
+	zombies := []int{}
+	for _, stat := range stats {
+		content, err := os.ReadFile(stat)
+		if err != nil {
+			// The process vanished between the glob and the read
+			continue
+		}
+		// The command name is between parenthesis and may contain spaces,
+		// so the state and ppid are read after the last closing one
+		line := string(content)
+		fields := strings.Fields(line[strings.LastIndex(line, ")")+1:])
+		if len(fields) < 2 || fields[0] != "Z" {
+			continue
+		}
+		parent, err := strconv.Atoi(fields[1])
+		if err != nil || parent != ppid {
+			continue
+		}
+		pid, err := strconv.Atoi(filepath.Base(filepath.Dir(stat)))
+		if err != nil {
+			continue
+		}
+		zombies = append(zombies, pid)
+	}
+	return zombies, nil
+}
+
+func setChildSubreaper() error {
+	return unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 1, 0, 0, 0)
+}
@@ -0,0 +1,164 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Name of the capture group identifying the player in join and leave rules
+const playerGroup = "player"
+
+// playerSet is the live set of players, maintained from join and leave
+// rules. Players joining without a name are only counted, and only a leave
+// without a name removes one of them. A count reported
+// by the server itself, when queried, takes precedence over the rules.
+type playerSet struct {
+	mu        sync.Mutex
+	named     map[string]struct{}
+	anonymous int
+	changed   chan int
+
+	reported      bool
+	reportedCount int
+	reportedNames []string
+}
+
+func newPlayerSet() *playerSet {
+	return &playerSet{
+		named:   map[string]struct{}{},
+		changed: make(chan int, 1),
+	}
+}
+
+func (p *playerSet) join(name string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if name == "" {
+		p.anonymous++
+	} else {
+		p.named[name] = struct{}{}
+	}
+	return p.notify()
+}
+
+func (p *playerSet) leave(name string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	previous := p.current()
+	if name == "" {
+		p.anonymous = max(p.anonymous-1, 0)
+	} else {
+		// A player not seen joining, e.g. a pattern capturing another
+		// identity, is ignored
+		delete(p.named, name)
+	}
+	if count := p.current(); count == previous {
+		return count
+	}
+	return p.notify()
+}
+
+// reset empties the set, when the process is restarted, and publishes the
+// count if it changed
+func (p *playerSet) reset() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	previous := p.current()
+	p.named = map[string]struct{}{}
+	p.anonymous = 0
+	p.reported = false
+	p.reportedCount = 0
+	p.reportedNames = nil
+	if previous == 0 {
+		return 0
+	}
+	return p.notify()
+}
+
+// report sets the player count reported by the server, and publishes it
+// if it changed. Names may be missing or partial.
+func (p *playerSet) report(count int, names []string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	previous := p.current()
+	p.reported = true
+	p.reportedCount = count
+	p.reportedNames = names
+	if count == previous {
+		return count
+	}
+	return p.notify()
+}
+
+// unreport falls back to the rules, when the server stops answering
+func (p *playerSet) unreport() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	previous := p.current()
+	p.reported = false
+	p.reportedNames = nil
+	if count := p.current(); count == previous {
+		return count
+	}
+	return p.notify()
+}
+
+// current return the player count. Must be called with the lock.
+func (p *playerSet) current() int {
+	if p.reported {
+		return p.reportedCount
+	}
+	return len(p.named) + p.anonymous
+}
+
+// notify publishes the player count, replacing a count not consumed yet so
+// that the reader always gets the latest one. Must be called with the lock.
+func (p *playerSet) notify() int {
+	count := p.current()
+	select {
+	case <-p.changed:
+	default:
+	}
+	p.changed <- count
+	return count
+}
+
+func (p *playerSet) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.current()
+}
+
+func (p *playerSet) isReported() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.reported
+}
+
+// names return the sorted names of the players, plus a placeholder for the
+// anonymous ones
+func (p *playerSet) names() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	names := []string{}
+	anonymous := p.anonymous
+	if p.reported {
+		names = append(names, p.reportedNames...)
+		anonymous = p.reportedCount - len(p.reportedNames)
+	} else {
+		for name := range p.named {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if anonymous > 0 {
+		names = append(names, fmt.Sprintf("%d unnamed", anonymous))
+	}
+	return names
+}
+
+func (p *playerSet) String() string {
+	return strings.Join(p.names(), ", ")
+}
@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"slices"
+	"testing"
+)
+
+// lastChange return the count published on changed, or -1 if none
+func lastChange(p *playerSet) int {
+	select {
+	case count := <-p.changed:
+		return count
+	default:
+		return -1
+	}
+}
+
+func TestPlayerSetJoinLeave(t *testing.T) {
+	type event struct {
+		join bool
+		name string
+	}
+	tests := []struct {
+		name   string
+		events []event
+		want   int
+		names  []string
+	}{
+		{"named", []event{{true, "alice"}, {true, "bob"}, {false, "alice"}}, 1, []string{"bob"}},
+		{"rejoin", []event{{true, "alice"}, {true, "alice"}}, 1, []string{"alice"}},
+		{"anonymous", []event{{true, ""}, {true, ""}, {false, ""}}, 1, []string{"1 unnamed"}},
+		// A leave under another identity removes nobody
+		{"unknown leave", []event{{true, "alice"}, {true, ""}, {false, "12345"}}, 2, []string{"alice", "1 unnamed"}},
+		{"leave when empty", []event{{false, ""}, {false, "alice"}}, 0, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newPlayerSet()
+			for _, e := range tt.events {
+				if e.join {
+					p.join(e.name)
+				} else {
+					p.leave(e.name)
+				}
+			}
+			if got := p.count(); got != tt.want {
+				t.Errorf("count() = %d, want %d", got, tt.want)
+			}
+			if got := p.names(); !slices.Equal(got, tt.names) {
+				t.Errorf("names() = %q, want %q", got, tt.names)
+			}
+		})
+	}
+}
+
+func TestPlayerSetLeavePublishesChanges(t *testing.T) {
+	p := newPlayerSet()
+	p.join("alice")
+	lastChange(p)
+	p.leave("bob")
+	if got := lastChange(p); got != -1 {
+		t.Errorf("published %d for an unknown leave", got)
+	}
+	p.leave("alice")
+	if got := lastChange(p); got != 0 {
+		t.Errorf("published %d, want 0", got)
+	}
+}
+
+func TestPlayerSetReset(t *testing.T) {
+	p := newPlayerSet()
+	p.join("alice")
+	p.join("")
+	if got := lastChange(p); got != 2 {
+		t.Fatalf("published %d, want 2", got)
+	}
+
+	if got := p.reset(); got != 0 {
+		t.Errorf("reset() = %d, want 0", got)
+	}
+	if got := lastChange(p); got != 0 {
+		t.Errorf("published %d after reset, want 0", got)
+	}
+	if got := p.names(); len(got) != 0 {
+		t.Errorf("names() = %q after reset, want none", got)
+	}
+
+	// Nothing to publish when already empty
+	p.reset()
+	if got := lastChange(p); got != -1 {
+		t.Errorf("published %d on an empty reset", got)
+	}
+}
+
+func TestPlayerSetReport(t *testing.T) {
+	p := newPlayerSet()
+	p.join("alice")
+	lastChange(p)
+
+	if got := p.report(3, []string{"bob"}); got != 3 {
+		t.Errorf("report() = %d, want 3", got)
+	}
+	if got := lastChange(p); got != 3 {
+		t.Errorf("published %d, want 3", got)
+	}
+	if got, want := p.names(), []string{"bob", "2 unnamed"}; !slices.Equal(got, want) {
+		t.Errorf("names() = %q, want %q", got, want)
+	}
+
+	// The same count is not published again
+	p.report(3, nil)
+	if got := lastChange(p); got != -1 {
+		t.Errorf("published %d for an unchanged count", got)
+	}
+
+	// Back to the rules
+	p.unreport()
+	if got := lastChange(p); got != 1 {
+		t.Errorf("published %d after unreport, want 1", got)
+	}
+	if p.reset(); p.isReported() {
+		t.Error("still reported after reset")
+	}
+}
@@ -0,0 +1,238 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Sources of network activity, for LSDC2_ACTIVITY_SOURCE
+const (
+	ActivitySourceSniff     = "sniff"
+	ActivitySourceProc      = "proc"
+	ActivitySourceConntrack = "conntrack"
+)
+
+// Socket tables read by the proc source, by protocol, and the conntrack
+// table
+var (
+	procNetTables = map[string][]string{
+		"tcp": {"/proc/net/tcp", "/proc/net/tcp6"},
+		"udp": {"/proc/net/udp", "/proc/net/udp6"},
+	}
+	procConntrack = "/proc/net/nf_conntrack"
+)
+
+// States of the sockets in the /proc/net tables
+const (
+	procEstablished = "01"
+	procClose       = "07"
+	procListen      = "0A"
+)
+
+// procSocket is a socket of a /proc/net table
+type procSocket struct {
+	localPort uint16
+	remote    netip.Addr
+	state     string
+}
+
+// procNetPeers return the remote addresses of the established TCP sockets
+// and connected UDP sockets whose local port is one of ports. If ports is
+// empty, the local port must be one the host listens on, so that the
+// connections of the host itself (to S3, CloudWatch and so on) are not
+// counted. Loopback peers are ignored.
+func procNetPeers(ports map[uint16]bool) ([]netip.Addr, error) {
+	peers := []netip.Addr{}
+	for _, tables := range procNetTables {
+		sockets := []procSocket{}
+		for _, table := range tables {
+			f, err := os.Open(table)
+			if os.IsNotExist(err) {
+				// No IPv6 in this kernel
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			tableSockets, err := parseProcNet(f)
+			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("%s / %w", table, err)
+			}
+			sockets = append(sockets, tableSockets...)
+		}
+		peers = append(peers, socketPeers(sockets, ports)...)
+	}
+	return peers, nil
+}
+
+// parseProcNet parses the sockets of a /proc/net table
+func parseProcNet(r io.Reader) ([]procSocket, error) {
+	sockets := []procSocket{}
+	scanner := bufio.NewScanner(r)
+	scanner.Scan() // Header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		_, localPort, err := parseProcNetAddr(fields[1])
+		if err != nil {
+			continue
+		}
+		remote, _, err := parseProcNetAddr(fields[2])
+		if err != nil {
+			continue
+		}
+		sockets = append(sockets, procSocket{localPort: localPort, remote: remote, state: fields[3]})
+	}
+	return sockets, scanner.Err()
+}
+
+// socketPeers return the peers of the connected sockets of a protocol, on
+// one of ports or else on a listening port. TCP listens with the LISTEN
+// state, UDP with unconnected sockets.
+func socketPeers(sockets []procSocket, ports map[uint16]bool) []netip.Addr {
+	if len(ports) == 0 {
+		ports = map[uint16]bool{}
+		for _, socket := range sockets {
+			if socket.state == procListen || (socket.state == procClose && socket.remote.IsUnspecified()) {
+				ports[socket.localPort] = true
+			}
+		}
+	}
+	peers := []netip.Addr{}
+	for _, socket := range sockets {
+		if socket.state != procEstablished || !ports[socket.localPort] {
+			continue
+		}
+		if socket.remote.IsUnspecified() || socket.remote.IsLoopback() {
+			continue
+		}
+		peers = append(peers, socket.remote)
+	}
+	return peers
+}
+
+// parseProcNetAddr parses the "ADDR:PORT" of /proc/net tables. The address
+// is printed as 32 bits words in host byte order, the port in hexadecimal.
+func parseProcNetAddr(s string) (netip.Addr, uint16, error) {
+	hexAddr, hexPort, found := strings.Cut(s, ":")
+	if !found {
+		return netip.Addr{}, 0, fmt.Errorf("invalid address %q", s)
+	}
+	raw, err := hex.DecodeString(hexAddr)
+	if err != nil || (len(raw) != 4 && len(raw) != 16) {
+		return netip.Addr{}, 0, fmt.Errorf("invalid address %q", s)
+	}
+	for i := 0; i < len(raw); i += 4 {
+		binary.NativeEndian.PutUint32(raw[i:], binary.BigEndian.Uint32(raw[i:]))
+	}
+	port, err := strconv.ParseUint(hexPort, 16, 16)
+	if err != nil {
+		return netip.Addr{}, 0, fmt.Errorf("invalid port %q", s)
+	}
+	addr, _ := netip.AddrFromSlice(raw)
+	return addr.Unmap(), uint16(port), nil
+}
+
+// conntrackFlow is the original direction of a tracked connection. Packets
+// and bytes are only counted with the nf_conntrack_acct sysctl.
+type conntrackFlow struct {
+	src     netip.Addr
+	packets int64
+	bytes   int64
+	counted bool
+}
+
+// readConntrack return the flows towards one of ports, or towards any port
+// if ports is empty, keyed by their tuple. Flows from a loopback or local
+// address are the connections of the host itself, and are ignored.
+func readConntrack(ports map[uint16]bool) (map[string]conntrackFlow, error) {
+	local, err := localAddrs()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(procConntrack)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseConntrack(f, ports, local)
+}
+
+// parseConntrack parses the flows of the conntrack table
+func parseConntrack(r io.Reader, ports map[uint16]bool, local map[netip.Addr]bool) (map[string]conntrackFlow, error) {
+	flows := map[string]conntrackFlow{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		// Only the first occurrence of each key, the original direction
+		values := map[string]string{}
+		for _, field := range fields {
+			key, value, found := strings.Cut(field, "=")
+			if _, seen := values[key]; found && !seen {
+				values[key] = value
+			}
+		}
+		src, err := netip.ParseAddr(values["src"])
+		if err != nil || src.IsLoopback() || local[src.Unmap()] {
+			continue
+		}
+		dport, err := strconv.ParseUint(values["dport"], 10, 16)
+		if err != nil || (len(ports) > 0 && !ports[uint16(dport)]) {
+			continue
+		}
+
+		flow := conntrackFlow{src: src}
+		if packets, ok := values["packets"]; ok {
+			flow.packets, _ = strconv.ParseInt(packets, 10, 64)
+			flow.bytes, _ = strconv.ParseInt(values["bytes"], 10, 64)
+			flow.counted = true
+		}
+		key := strings.Join([]string{fields[2], values["src"], values["dst"], values["sport"], values["dport"]}, " ")
+		flows[key] = flow
+	}
+	return flows, scanner.Err()
+}
+
+// localAddrs return the addresses of the host interfaces
+func localAddrs() (map[netip.Addr]bool, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("net.InterfaceAddrs / %w", err)
+	}
+	local := map[netip.Addr]bool{}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			if ip, ok := netip.AddrFromSlice(ipNet.IP); ok {
+				local[ip.Unmap()] = true
+			}
+		}
+	}
+	return local, nil
+}
+
+// parseActivityPorts parses the local ports of the game
+func parseActivityPorts(ports []string) (map[uint16]bool, error) {
+	parsed := map[uint16]bool{}
+	for _, port := range ports {
+		p, err := strconv.ParseUint(strings.TrimSpace(port), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", port)
+		}
+		parsed[uint16(p)] = true
+	}
+	return parsed, nil
+}
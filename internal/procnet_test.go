@@ -0,0 +1,148 @@
+package internal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// procNetHex formats an address the way /proc/net prints it: each 32 bits
+// word in host byte order
+func procNetHex(addr string, port uint16) string {
+	raw := netip.MustParseAddr(addr).AsSlice()
+	for i := 0; i < len(raw); i += 4 {
+		binary.BigEndian.PutUint32(raw[i:], binary.NativeEndian.Uint32(raw[i:]))
+	}
+	return fmt.Sprintf("%X:%04X", raw, port)
+}
+
+func TestParseProcNetAddr(t *testing.T) {
+	// Fixtures of a little endian host
+	if binary.NativeEndian.Uint16([]byte{1, 0}) != 1 {
+		t.Skip("big endian host")
+	}
+	tests := []struct {
+		hex  string
+		addr string
+		port uint16
+	}{
+		{"0100007F:0998", "127.0.0.1", 2456},
+		{"0102000A:C350", "10.0.2.1", 50000},
+		{"00000000:0000", "0.0.0.0", 0},
+		{"B80D0120000000000000000001000000:0998", "2001:db8::1", 2456},
+		{"0000000000000000FFFF00000102000A:0035", "10.0.2.1", 53},
+		{"00000000000000000000000000000000:0000", "::", 0},
+	}
+	for _, tt := range tests {
+		addr, port, err := parseProcNetAddr(tt.hex)
+		if err != nil {
+			t.Errorf("parseProcNetAddr(%q) / %v", tt.hex, err)
+			continue
+		}
+		if addr != netip.MustParseAddr(tt.addr) || port != tt.port {
+			t.Errorf("parseProcNetAddr(%q) = %v, %d, want %s, %d", tt.hex, addr, port, tt.addr, tt.port)
+		}
+	}
+	for _, invalid := range []string{"0100007F", "0100007F:", "01007F:0998", "ZZ00007F:0998", "0100007F:10000"} {
+		if _, _, err := parseProcNetAddr(invalid); err == nil {
+			t.Errorf("parseProcNetAddr(%q) succeeded", invalid)
+		}
+	}
+}
+
+func TestProcNetPeers(t *testing.T) {
+	socket := func(local string, localPort uint16, remote string, remotePort uint16, state string) string {
+		return "   0: " + procNetHex(local, localPort) + " " + procNetHex(remote, remotePort) + " " + state +
+			" 00000000:00000000 00:00000000 00000000  1000        0 12345 1 0000000000000000 100 0 0 10 0"
+	}
+	const header = "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n"
+	tcp := header + strings.Join([]string{
+		// The game listens on 2456, a client and a local peer are connected
+		socket("0.0.0.0", 2456, "0.0.0.0", 0, procListen),
+		socket("10.0.0.1", 2456, "192.0.2.1", 50000, procEstablished),
+		socket("127.0.0.1", 2456, "127.0.0.1", 40000, procEstablished),
+		// The wrapper uploads to S3 from an ephemeral port
+		socket("10.0.0.1", 43210, "52.216.0.1", 443, procEstablished),
+		// A client leaving
+		socket("10.0.0.1", 2456, "192.0.2.2", 50001, "06"),
+	}, "\n")
+	udp := header + strings.Join([]string{
+		socket("0.0.0.0", 2457, "0.0.0.0", 0, procClose),
+		socket("10.0.0.1", 2457, "192.0.2.3", 50002, procEstablished),
+		socket("10.0.0.1", 45678, "169.254.169.254", 80, procEstablished),
+	}, "\n")
+
+	tests := []struct {
+		name  string
+		table string
+		ports map[uint16]bool
+		want  []string
+	}{
+		{"tcp listening", tcp, nil, []string{"192.0.2.1"}},
+		{"tcp ports", tcp, map[uint16]bool{43210: true}, []string{"52.216.0.1"}},
+		{"udp listening", udp, nil, []string{"192.0.2.3"}},
+		{"udp ports", udp, map[uint16]bool{2456: true}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sockets, err := parseProcNet(strings.NewReader(tt.table))
+			if err != nil {
+				t.Fatalf("parseProcNet / %v", err)
+			}
+			got := []string{}
+			for _, peer := range socketPeers(sockets, tt.ports) {
+				got = append(got, peer.String())
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("peers = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseConntrack(t *testing.T) {
+	const table = `ipv4     2 udp      17 29 src=192.0.2.1 dst=10.0.0.1 sport=50000 dport=2456 packets=12 bytes=1200 src=10.0.0.1 dst=192.0.2.1 sport=2456 dport=50000 packets=10 bytes=3000 [ASSURED] mark=0 zone=0 use=2
+ipv4     2 tcp      6 431999 ESTABLISHED src=10.0.0.1 dst=52.216.0.1 sport=43210 dport=443 packets=40 bytes=9000 src=52.216.0.1 dst=10.0.0.1 sport=443 dport=43210 packets=30 bytes=80000 [ASSURED] mark=0 zone=0 use=2
+ipv4     2 udp      17 10 src=127.0.0.1 dst=127.0.0.1 sport=40000 dport=2456 packets=1 bytes=100 src=127.0.0.1 dst=127.0.0.1 sport=2456 dport=40000 packets=1 bytes=100 mark=0 zone=0 use=2
+ipv6     10 udp      17 29 src=2001:db8::2 dst=2001:db8::1 sport=50000 dport=2457 src=2001:db8::1 dst=2001:db8::2 sport=2457 dport=50000 [ASSURED] mark=0 zone=0 use=2
+ipv4     2 udp      17 29 src=192.0.2.4 dst=10.0.0.1 sport=50000 dport=53 packets=1 bytes=60 src=10.0.0.1 dst=192.0.2.4 sport=53 dport=50000 packets=1 bytes=90 mark=0 zone=0 use=2
+garbage
+`
+	local := map[netip.Addr]bool{netip.MustParseAddr("10.0.0.1"): true, netip.MustParseAddr("2001:db8::1"): true}
+
+	tests := []struct {
+		name  string
+		ports map[uint16]bool
+		want  map[string]conntrackFlow
+	}{
+		{"ports", map[uint16]bool{2456: true, 2457: true}, map[string]conntrackFlow{
+			"udp 192.0.2.1 10.0.0.1 50000 2456":      {src: netip.MustParseAddr("192.0.2.1"), packets: 12, bytes: 1200, counted: true},
+			"udp 2001:db8::2 2001:db8::1 50000 2457": {src: netip.MustParseAddr("2001:db8::2")},
+		}},
+		// The flow of the host itself towards S3 is never a client
+		{"any port", nil, map[string]conntrackFlow{
+			"udp 192.0.2.1 10.0.0.1 50000 2456":      {src: netip.MustParseAddr("192.0.2.1"), packets: 12, bytes: 1200, counted: true},
+			"udp 2001:db8::2 2001:db8::1 50000 2457": {src: netip.MustParseAddr("2001:db8::2")},
+			"udp 192.0.2.4 10.0.0.1 50000 53":        {src: netip.MustParseAddr("192.0.2.4"), packets: 1, bytes: 60, counted: true},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flows, err := parseConntrack(strings.NewReader(table), tt.ports, local)
+			if err != nil {
+				t.Fatalf("parseConntrack / %v", err)
+			}
+			if len(flows) != len(tt.want) {
+				t.Errorf("flows = %v, want %v", flows, tt.want)
+			}
+			for key, want := range tt.want {
+				if got, ok := flows[key]; !ok || got != want {
+					t.Errorf("flow %q = %+v, want %+v", key, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,286 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Query protocols, for LSDC2_QUERY_PROTOCOL
+const (
+	QueryProtocolA2S       = "a2s"
+	QueryProtocolMinecraft = "minecraft"
+	QueryProtocolGameSpy4  = "gamespy4"
+)
+
+// serverInfo is what a game reports about itself when queried
+type serverInfo struct {
+	Name        string
+	Map         string
+	Players     int
+	MaxPlayers  int
+	PlayerNames []string
+}
+
+func (i serverInfo) String() string {
+	s := fmt.Sprintf("%d/%d players", i.Players, i.MaxPlayers)
+	if i.Map != "" {
+		s = fmt.Sprintf("map %s, %s", i.Map, s)
+	}
+	return s
+}
+
+// queryServer queries the server at address with a protocol
+func queryServer(protocol string, address string, timeout time.Duration) (serverInfo, error) {
+	switch protocol {
+	case QueryProtocolA2S:
+		return queryA2S(address, timeout)
+	case QueryProtocolMinecraft:
+		return queryMinecraft(address, timeout)
+	case QueryProtocolGameSpy4:
+		return queryGameSpy4(address, timeout)
+	}
+	return serverInfo{}, fmt.Errorf("unknown query protocol %v", protocol)
+}
+
+// Headers of the Steam A2S queries and responses
+var a2sHeader = []byte{0xff, 0xff, 0xff, 0xff}
+
+const (
+	a2sInfoRequest    = 'T'
+	a2sInfoResponse   = 'I'
+	a2sPlayerRequest  = 'U'
+	a2sPlayerResponse = 'D'
+	a2sChallenge      = 'A'
+)
+
+// queryA2S sends A2S_INFO, then A2S_PLAYER for the names. Bots are not
+// counted as players.
+func queryA2S(address string, timeout time.Duration) (serverInfo, error) {
+	conn, err := net.DialTimeout("udp", address, timeout)
+	if err != nil {
+		return serverInfo{}, fmt.Errorf("net.DialTimeout / %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	infoRequest := append(append([]byte{}, a2sHeader...), append([]byte{a2sInfoRequest}, "Source Engine Query\x00"...)...)
+	response, err := a2sRequest(conn, infoRequest, nil, a2sInfoResponse)
+	if err != nil {
+		return serverInfo{}, fmt.Errorf("A2S_INFO / %w", err)
+	}
+
+	r := bytes.NewReader(response)
+	info := serverInfo{}
+	r.ReadByte() // Protocol
+	info.Name = readCString(r)
+	info.Map = readCString(r)
+	readCString(r) // Folder
+	readCString(r) // Game
+	r.Seek(2, io.SeekCurrent)
+	players, _ := r.ReadByte()
+	maxPlayers, _ := r.ReadByte()
+	bots, err := r.ReadByte()
+	if err != nil {
+		return serverInfo{}, fmt.Errorf("A2S_INFO / truncated response")
+	}
+	info.Players = max(int(players)-int(bots), 0)
+	info.MaxPlayers = int(maxPlayers)
+
+	// Names are a bonus, some servers do not answer A2S_PLAYER
+	playerRequest := append(append([]byte{}, a2sHeader...), a2sPlayerRequest)
+	response, err = a2sRequest(conn, playerRequest, []byte{0xff, 0xff, 0xff, 0xff}, a2sPlayerResponse)
+	if err != nil || len(response) < 1 {
+		return info, nil
+	}
+	r = bytes.NewReader(response[1:])
+	for i := 0; i < int(response[0]); i++ {
+		r.ReadByte() // Index
+		name := readCString(r)
+		// Score and duration
+		if r.Len() < 8 {
+			break
+		}
+		r.Seek(8, io.SeekCurrent)
+		if name != "" {
+			info.PlayerNames = append(info.PlayerNames, name)
+		}
+	}
+	return info, nil
+}
+
+// a2sRequest sends a request, answering the challenge if the server sends
+// one. Return the payload of the expected response.
+func a2sRequest(conn net.Conn, request []byte, challenge []byte, expected byte) ([]byte, error) {
+	buffer := make([]byte, 1400)
+	for attempt := 0; attempt < 2; attempt++ {
+		if _, err := conn.Write(append(append([]byte{}, request...), challenge...)); err != nil {
+			return nil, err
+		}
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return nil, err
+		}
+		if n < 5 || !bytes.Equal(buffer[:4], a2sHeader) {
+			return nil, errors.New("unexpected response")
+		}
+		switch buffer[4] {
+		case expected:
+			return buffer[5:n], nil
+		case a2sChallenge:
+			challenge = append([]byte{}, buffer[5:n]...)
+		default:
+			return nil, fmt.Errorf("unexpected response type %q", buffer[4])
+		}
+	}
+	return nil, errors.New("challenge not accepted")
+}
+
+// minecraftStatus is the part of the Server List Ping status used
+type minecraftStatus struct {
+	Description json.RawMessage
+	Players     struct {
+		Max    int
+		Online int
+		Sample []struct {
+			Name string
+		}
+	}
+}
+
+// queryMinecraft sends a Server List Ping handshake and status request
+func queryMinecraft(address string, timeout time.Duration) (serverInfo, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return serverInfo{}, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return serverInfo{}, err
+	}
+
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return serverInfo{}, fmt.Errorf("net.DialTimeout / %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	// Handshake with protocol version -1 and next state status, then a
+	// status request
+	handshake := []byte{0x00}
+	handshake = binary.AppendUvarint(handshake, 0xffffffff)
+	handshake = binary.AppendUvarint(handshake, uint64(len(host)))
+	handshake = append(handshake, host...)
+	handshake = binary.BigEndian.AppendUint16(handshake, uint16(port))
+	handshake = append(handshake, 0x01)
+	packets := binary.AppendUvarint(nil, uint64(len(handshake)))
+	packets = append(packets, handshake...)
+	packets = append(packets, 0x01, 0x00)
+	if _, err := conn.Write(packets); err != nil {
+		return serverInfo{}, err
+	}
+
+	r := bufio.NewReader(conn)
+	if _, err := binary.ReadUvarint(r); err != nil { // Packet length
+		return serverInfo{}, err
+	}
+	if id, err := binary.ReadUvarint(r); err != nil || id != 0x00 {
+		return serverInfo{}, errors.New("unexpected response")
+	}
+	length, err := binary.ReadUvarint(r)
+	if err != nil || length > 1<<20 {
+		return serverInfo{}, errors.New("unexpected response")
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return serverInfo{}, err
+	}
+
+	status := minecraftStatus{}
+	if err := json.Unmarshal(payload, &status); err != nil {
+		return serverInfo{}, fmt.Errorf("json.Unmarshal / %w", err)
+	}
+	info := serverInfo{Players: status.Players.Online, MaxPlayers: status.Players.Max}
+	// The description is a string or a chat component
+	var description struct{ Text string }
+	if json.Unmarshal(status.Description, &info.Name) != nil && json.Unmarshal(status.Description, &description) == nil {
+		info.Name = description.Text
+	}
+	for _, player := range status.Players.Sample {
+		info.PlayerNames = append(info.PlayerNames, player.Name)
+	}
+	return info, nil
+}
+
+// Session id of the GameSpy4 queries. Some servers only keep the low
+// nibble of each byte.
+var gameSpy4Session = []byte{0x01, 0x01, 0x01, 0x01}
+
+// queryGameSpy4 sends a handshake, then a basic stat request
+func queryGameSpy4(address string, timeout time.Duration) (serverInfo, error) {
+	conn, err := net.DialTimeout("udp", address, timeout)
+	if err != nil {
+		return serverInfo{}, fmt.Errorf("net.DialTimeout / %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	buffer := make([]byte, 1400)
+	if _, err := conn.Write(append([]byte{0xfe, 0xfd, 0x09}, gameSpy4Session...)); err != nil {
+		return serverInfo{}, err
+	}
+	n, err := conn.Read(buffer)
+	if err != nil {
+		return serverInfo{}, fmt.Errorf("handshake / %w", err)
+	}
+	if n < 6 || buffer[0] != 0x09 {
+		return serverInfo{}, errors.New("handshake / unexpected response")
+	}
+	challenge, err := strconv.ParseInt(readCString(bytes.NewReader(buffer[5:n])), 10, 32)
+	if err != nil {
+		return serverInfo{}, fmt.Errorf("handshake / %w", err)
+	}
+
+	request := append([]byte{0xfe, 0xfd, 0x00}, gameSpy4Session...)
+	request = binary.BigEndian.AppendUint32(request, uint32(challenge))
+	if _, err := conn.Write(request); err != nil {
+		return serverInfo{}, err
+	}
+	if n, err = conn.Read(buffer); err != nil {
+		return serverInfo{}, fmt.Errorf("stat / %w", err)
+	}
+	if n < 5 || buffer[0] != 0x00 {
+		return serverInfo{}, errors.New("stat / unexpected response")
+	}
+
+	// MOTD, game type, map, players and max players
+	r := bytes.NewReader(buffer[5:n])
+	info := serverInfo{Name: readCString(r)}
+	readCString(r)
+	info.Map = readCString(r)
+	if info.Players, err = strconv.Atoi(readCString(r)); err != nil {
+		return serverInfo{}, errors.New("stat / invalid player count")
+	}
+	info.MaxPlayers, _ = strconv.Atoi(readCString(r))
+	return info, nil
+}
+
+// readCString reads a null terminated string
+func readCString(r *bytes.Reader) string {
+	s := []byte{}
+	for {
+		c, err := r.ReadByte()
+		if err != nil || c == 0 {
+			return string(s)
+		}
+		s = append(s, c)
+	}
+}
@@ -0,0 +1,316 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const testQueryTimeout = 500 * time.Millisecond
+
+// udpResponder answers each datagram received on a loopback address with
+// the datagrams respond returns
+func udpResponder(t *testing.T, respond func(request []byte) [][]byte) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.ListenPacket / %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buffer := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			for _, response := range respond(append([]byte{}, buffer[:n]...)) {
+				conn.WriteTo(response, addr)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// a2sPacket builds an A2S response of a type
+func a2sPacket(kind byte, payload ...[]byte) []byte {
+	return append(append(append([]byte{}, a2sHeader...), kind), bytes.Join(payload, nil)...)
+}
+
+var (
+	a2sInfoPayload = [][]byte{
+		{17},                   // Protocol
+		[]byte("Valheim\x00"),  // Name
+		[]byte("Meadows\x00"),  // Map
+		[]byte("valheim\x00"),  // Folder
+		[]byte("Valheim\x00"),  // Game
+		{0xc4, 0x07},           // Steam app id
+		{3, 10, 1},             // Players, max players and bots
+		{'d', 'l', 0, 0, 0},    // Type, environment, visibility, VAC
+		[]byte("0.217.46\x00"), // Version
+	}
+	a2sPlayerPayload = [][]byte{
+		{2},
+		{0}, []byte("alice\x00"), make([]byte, 8),
+		{1}, []byte("bob\x00"), make([]byte, 8),
+	}
+	a2sChallengeNumber = []byte{0x12, 0x34, 0x56, 0x78}
+)
+
+// a2sServer answers A2S_INFO and A2S_PLAYER, asking for a challenge first
+// if challenged
+func a2sServer(challenged bool, info []byte, player []byte) func([]byte) [][]byte {
+	return func(request []byte) [][]byte {
+		if challenged && !bytes.HasSuffix(request, a2sChallengeNumber) {
+			return [][]byte{a2sPacket(a2sChallenge, a2sChallengeNumber)}
+		}
+		switch request[4] {
+		case a2sInfoRequest:
+			return [][]byte{info}
+		case a2sPlayerRequest:
+			if player != nil {
+				return [][]byte{player}
+			}
+		}
+		return nil
+	}
+}
+
+func TestQueryA2S(t *testing.T) {
+	info := a2sPacket(a2sInfoResponse, a2sInfoPayload...)
+	player := a2sPacket(a2sPlayerResponse, a2sPlayerPayload...)
+	tests := []struct {
+		name    string
+		respond func([]byte) [][]byte
+		want    serverInfo
+		wantErr bool
+	}{
+		{"info and players", a2sServer(false, info, player),
+			serverInfo{Name: "Valheim", Map: "Meadows", Players: 2, MaxPlayers: 10, PlayerNames: []string{"alice", "bob"}}, false},
+		{"challenge", a2sServer(true, info, player),
+			serverInfo{Name: "Valheim", Map: "Meadows", Players: 2, MaxPlayers: 10, PlayerNames: []string{"alice", "bob"}}, false},
+		// Names are optional
+		{"no players", a2sServer(false, info, nil),
+			serverInfo{Name: "Valheim", Map: "Meadows", Players: 2, MaxPlayers: 10}, false},
+		{"truncated players", a2sServer(false, info, player[:len(player)-4]),
+			serverInfo{Name: "Valheim", Map: "Meadows", Players: 2, MaxPlayers: 10, PlayerNames: []string{"alice"}}, false},
+		{"truncated info", a2sServer(false, info[:len(info)-16], player), serverInfo{}, true},
+		{"wrong header", a2sServer(false, append([]byte{0xfe}, info[1:]...), player), serverInfo{}, true},
+		{"wrong type", a2sServer(false, a2sPacket('X'), player), serverInfo{}, true},
+		// A challenge never accepted
+		{"challenge loop", func([]byte) [][]byte { return [][]byte{a2sPacket(a2sChallenge, a2sChallengeNumber)} }, serverInfo{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := queryServer(QueryProtocolA2S, udpResponder(t, tt.respond), testQueryTimeout)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("queryA2S error = %v, want error %v", err, tt.wantErr)
+			}
+			if !equalServerInfo(got, tt.want) {
+				t.Errorf("queryA2S = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryA2STimeout(t *testing.T) {
+	address := udpResponder(t, func([]byte) [][]byte { return nil })
+	if _, err := queryA2S(address, 100*time.Millisecond); err == nil {
+		t.Error("queryA2S succeeded without answer")
+	}
+}
+
+// minecraftResponse frames a status response
+func minecraftResponse(status string) []byte {
+	packet := []byte{0x00}
+	packet = binary.AppendUvarint(packet, uint64(len(status)))
+	packet = append(packet, status...)
+	return append(binary.AppendUvarint(nil, uint64(len(packet))), packet...)
+}
+
+// minecraftServer answers the Server List Ping on a loopback port with
+// response, after checking the handshake
+func minecraftServer(t *testing.T, response []byte) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen / %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	address := listener.Addr().(*net.TCPAddr)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(testQueryTimeout))
+
+		// Handshake with next state status, then a status request
+		handshake := []byte{0x00}
+		handshake = binary.AppendUvarint(handshake, 0xffffffff)
+		handshake = binary.AppendUvarint(handshake, uint64(len("127.0.0.1")))
+		handshake = append(handshake, "127.0.0.1"...)
+		handshake = binary.BigEndian.AppendUint16(handshake, uint16(address.Port))
+		handshake = append(handshake, 0x01)
+		want := append(binary.AppendUvarint(nil, uint64(len(handshake))), handshake...)
+		want = append(want, 0x01, 0x00)
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("handshake = %x, want %x", got, want)
+			return
+		}
+		conn.Write(response)
+	}()
+	return address.String()
+}
+
+func TestQueryMinecraft(t *testing.T) {
+	full := minecraftResponse(`{"version":{"name":"1.21","protocol":767},"players":{"max":20,"online":2,"sample":[{"name":"alice","id":"1"},{"name":"bob","id":"2"}]},"description":"A Minecraft Server"}`)
+	tests := []struct {
+		name     string
+		response []byte
+		want     serverInfo
+		wantErr  bool
+	}{
+		{"status", full, serverInfo{Name: "A Minecraft Server", Players: 2, MaxPlayers: 20, PlayerNames: []string{"alice", "bob"}}, false},
+		{"chat component", minecraftResponse(`{"players":{"max":10,"online":0},"description":{"text":"Hello"}}`),
+			serverInfo{Name: "Hello", MaxPlayers: 10}, false},
+		{"truncated", full[:len(full)-10], serverInfo{}, true},
+		{"invalid json", minecraftResponse(`{"players":`), serverInfo{}, true},
+		{"wrong packet", append([]byte{0x02, 0x01}, full[2:]...), serverInfo{}, true},
+		{"empty", nil, serverInfo{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := queryServer(QueryProtocolMinecraft, minecraftServer(t, tt.response), testQueryTimeout)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("queryMinecraft error = %v, want error %v", err, tt.wantErr)
+			}
+			if !equalServerInfo(got, tt.want) {
+				t.Errorf("queryMinecraft = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// gameSpy4Server answers the handshake with a challenge, then the basic
+// stat request carrying that challenge with stat
+func gameSpy4Server(challenge string, stat []byte) func([]byte) [][]byte {
+	return func(request []byte) [][]byte {
+		session := append([]byte{}, gameSpy4Session...)
+		switch {
+		case bytes.Equal(request, append([]byte{0xfe, 0xfd, 0x09}, session...)):
+			return [][]byte{append(append([]byte{0x09}, session...), challenge+"\x00"...)}
+		case len(request) == 11 && request[2] == 0x00 && binary.BigEndian.Uint32(request[7:]) == 9513307:
+			return [][]byte{stat}
+		}
+		return nil
+	}
+}
+
+func TestQueryGameSpy4(t *testing.T) {
+	stat := append(append([]byte{0x00}, gameSpy4Session...), "A Minecraft Server\x00SMP\x00world\x003\x0020\x0025565\x00127.0.0.1\x00"...)
+	tests := []struct {
+		name      string
+		challenge string
+		stat      []byte
+		want      serverInfo
+		wantErr   bool
+	}{
+		{"stat", "9513307", stat, serverInfo{Name: "A Minecraft Server", Map: "world", Players: 3, MaxPlayers: 20}, false},
+		// The stat request is answered only with the right challenge
+		{"wrong challenge", "42", stat, serverInfo{}, true},
+		{"invalid challenge", "abc", stat, serverInfo{}, true},
+		{"truncated", "9513307", stat[:len(stat)-30], serverInfo{}, true},
+		{"short", "9513307", stat[:3], serverInfo{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			address := udpResponder(t, gameSpy4Server(tt.challenge, tt.stat))
+			got, err := queryGameSpy4(address, testQueryTimeout)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("queryGameSpy4 error = %v, want error %v", err, tt.wantErr)
+			}
+			if !equalServerInfo(got, tt.want) {
+				t.Errorf("queryGameSpy4 = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestQueryProber checks that a couple of lost replies keep the reported
+// count, and that the prober answers immediate queries
+func TestQueryProber(t *testing.T) {
+	info := a2sPacket(a2sInfoResponse, a2sInfoPayload...)
+	serve := a2sServer(false, info, a2sPacket(a2sPlayerResponse, a2sPlayerPayload...))
+	infoRequests := atomic.Int32{}
+	address := udpResponder(t, func(request []byte) [][]byte {
+		// The 3rd and 4th info requests are lost
+		if request[4] == a2sInfoRequest {
+			if n := infoRequests.Add(1); n == 3 || n == 4 {
+				return nil
+			}
+		}
+		return serve(request)
+	})
+	w := Wrapped{
+		logger:        zap.NewNop(),
+		players:       newPlayerSet(),
+		queryNow:      make(chan chan *serverInfo, 1),
+		QueryProtocol: QueryProtocolA2S,
+		QueryAddress:  address,
+		QueryInterval: 20 * time.Millisecond,
+		QueryTimeout:  50 * time.Millisecond,
+	}
+	published := make(chan []int)
+	stop := make(chan struct{})
+	go func() {
+		counts := []int{}
+		for {
+			select {
+			case count := <-w.players.changed:
+				counts = append(counts, count)
+			case <-stop:
+				published <- counts
+				return
+			}
+		}
+	}()
+	w.StartQueryProber()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for infoRequests.Load() < 6 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stop)
+	if got := <-published; !slices.Equal(got, []int{2}) {
+		t.Errorf("published %v, want only 2 and no fallback to the rules", got)
+	}
+	if !w.players.isReported() {
+		t.Error("count not reported anymore")
+	}
+
+	got := w.queryImmediately()
+	if got == nil || got.Map != "Meadows" || got.MaxPlayers != 10 {
+		t.Errorf("queryImmediately() = %+v, want the map and max players", got)
+	}
+}
+
+func TestQueryServerUnknown(t *testing.T) {
+	if _, err := queryServer("quake3", "127.0.0.1:27960", testQueryTimeout); err == nil {
+		t.Error("queryServer succeeded with an unknown protocol")
+	}
+}
+
+func equalServerInfo(a serverInfo, b serverInfo) bool {
+	return a.Name == b.Name && a.Map == b.Map && a.Players == b.Players && a.MaxPlayers == b.MaxPlayers &&
+		slices.Equal(a.PlayerNames, b.PlayerNames)
+}
@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"strings"
+	"sync"
+)
+
+// lineRing keeps the last lines of output
+type lineRing struct {
+	mu    sync.Mutex
+	lines []string
+	next  int
+	full  bool
+}
+
+func newLineRing(size int) *lineRing {
+	return &lineRing{lines: make([]string, size)}
+}
+
+func (r *lineRing) add(line string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.lines) == 0 {
+		return
+	}
+	r.lines[r.next] = line
+	r.next = (r.next + 1) % len(r.lines)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// last return the lines kept, oldest first
+func (r *lineRing) last() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]string{}, r.lines[:r.next]...)
+	}
+	return append(append([]string{}, r.lines[r.next:]...), r.lines[:r.next]...)
+}
+
+// tail return the last lines kept, joined and truncated from the start to
+// fit in maxLen bytes
+func (r *lineRing) tail(maxLen int) string {
+	text := strings.Join(r.last(), "\n")
+	if len(text) > maxLen {
+		text = "..." + strings.ToValidUTF8(text[len(text)-maxLen+3:], "")
+	}
+	return text
+}
@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// rotatingFile writes lines to files under dir, starting a new file when the
+// current one exceeds maxSize bytes or is older than maxAge. Files are named
+// <prefix>-<index>.log, the index growing with each rotation.
+type rotatingFile struct {
+	mu      sync.Mutex
+	dir     string
+	prefix  string
+	maxSize int64
+	maxAge  time.Duration
+
+	file   *os.File
+	size   int64
+	opened time.Time
+	paths  []string
+}
+
+func newRotatingFile(dir string, prefix string, maxSize int64, maxAge time.Duration) (*rotatingFile, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("os.MkdirAll / %w", err)
+	}
+	r := &rotatingFile{
+		dir:     dir,
+		prefix:  prefix,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+	}
+	if err := r.rotate(); err != nil {
+		return nil, fmt.Errorf("rotate / %w", err)
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) writeLine(line string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return os.ErrClosed
+	}
+
+	if (r.maxSize > 0 && r.size+int64(len(line))+1 > r.maxSize && r.size > 0) ||
+		(r.maxAge > 0 && time.Since(r.opened) > r.maxAge) {
+		if err := r.rotate(); err != nil {
+			return fmt.Errorf("rotate / %w", err)
+		}
+	}
+
+	n, err := r.file.WriteString(line + "\n")
+	r.size += int64(n)
+	return err
+}
+
+// rotate closes the current file and opens the next one. Must be called with
+// the lock, or before the file is shared.
+func (r *rotatingFile) rotate() error {
+	if r.file != nil {
+		r.file.Close()
+	}
+	path := filepath.Join(r.dir, fmt.Sprintf("%s-%03d.log", r.prefix, len(r.paths)))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		r.file = nil
+		return err
+	}
+	r.file = file
+	r.size = 0
+	r.opened = time.Now()
+	r.paths = append(r.paths, path)
+	return nil
+}
+
+// close closes the current file and return the paths of every file written
+func (r *rotatingFile) close() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+	return append([]string{}, r.paths...)
+}
@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// Actions a rule can trigger when its pattern matches a scanned line
+const (
+	RuleNotify      = "notify"
+	RuleLog         = "log"
+	RuleReady       = "ready"
+	RulePlayerJoin  = "player-join"
+	RulePlayerLeave = "player-leave"
+	RuleSave        = "save"
+	RuleStop        = "stop"
+)
+
+// Rule maps the lines matching Pattern to an Action. Message is a template
+// executed with the named capture groups of the pattern, e.g.
+//
+//	{
+//	  "Pattern": "Got character ZDOID from (?P<player>\\w+)",
+//	  "Action": "notify",
+//	  "Level": "info",
+//	  "Message": "{{ .player }} joined the game"
+//	}
+type Rule struct {
+	Pattern string
+	Action  string
+	Level   string
+	Message string
+
+	regexp  *regexp.Regexp
+	message *template.Template
+}
+
+// ruleMatch is a line matched by a rule, with its named capture groups
+type ruleMatch struct {
+	rule   *Rule
+	line   string
+	groups map[string]string
+}
+
+// loadRules reads a JSON list of rules and compiles them
+func loadRules(path string) ([]*Rule, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile / %w", err)
+	}
+	rules := []*Rule{}
+	if err := json.Unmarshal(content, &rules); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal / %w", err)
+	}
+	for i, rule := range rules {
+		if err := rule.compile(); err != nil {
+			return nil, fmt.Errorf("rule %d / %w", i, err)
+		}
+	}
+	return rules, nil
+}
+
+func (r *Rule) compile() error {
+	switch r.Action {
+	case RuleNotify, RuleLog, RuleReady, RulePlayerJoin, RulePlayerLeave, RuleSave, RuleStop:
+	default:
+		return fmt.Errorf("unknown action %v", r.Action)
+	}
+	if r.Level == "" {
+		r.Level = "info"
+	}
+
+	var err error
+	if r.regexp, err = regexp.Compile(r.Pattern); err != nil {
+		return fmt.Errorf("regexp.Compile / %w", err)
+	}
+	if r.message, err = template.New(r.Pattern).Option("missingkey=zero").Parse(r.Message); err != nil {
+		return fmt.Errorf("template.Parse / %w", err)
+	}
+	return nil
+}
+
+// match return the named capture groups if the line matches the rule
+func (r *Rule) match(line string) (map[string]string, bool) {
+	submatches := r.regexp.FindStringSubmatch(line)
+	if submatches == nil {
+		return nil, false
+	}
+	groups := map[string]string{}
+	for i, name := range r.regexp.SubexpNames() {
+		if name != "" {
+			groups[name] = submatches[i]
+		}
+	}
+	return groups, true
+}
+
+// render executes the rule message template, or return the line itself if
+// the rule has no message
+func (m ruleMatch) render() string {
+	if m.rule.Message == "" {
+		return m.line
+	}
+	buf := strings.Builder{}
+	if err := m.rule.message.Execute(&buf, m.groups); err != nil {
+		return m.line
+	}
+	return buf.String()
+}
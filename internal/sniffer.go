@@ -0,0 +1,272 @@
+package internal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Bytes of each packet kept by the filters, enough for the headers
+const MTU = 128
+
+// Geometry of the RX ring. Packets are truncated by the filter to MTU
+// bytes, so small blocks hold many of them.
+const (
+	sniffBlockSize  = 1 << 16
+	sniffBlockCount = 8
+	sniffFrameSize  = 1 << 11
+)
+
+// Offsets of the block_status, num_pkts and offset_to_first_pkt fields of
+// tpacket_block_desc, after the version and offset_to_priv fields
+const (
+	blockStatusOffset      = 8
+	blockPacketsOffset     = 12
+	blockFirstPacketOffset = 16
+)
+
+// Offsets of the tp_next_offset, tp_sec, tp_nsec, tp_snaplen, tp_len,
+// tp_mac and tp_net fields of tpacket3_hdr
+const (
+	packetNextOffset    = 0
+	packetSecOffset     = 4
+	packetNsecOffset    = 8
+	packetSnaplenOffset = 12
+	packetLenOffset     = 16
+	packetMacOffset     = 24
+	packetNetOffset     = 26
+)
+
+// sniffer counts the packets matching a BPF filter on an interface, from a
+// memory-mapped TPACKET_V3 ring that stays open for the wrapper lifetime, so
+// that no packet goes unseen between two checks. Packets are accounted per
+// source IP, in stats that may be shared by the sniffers of several
+// interfaces. Without stats, the sniffer only feeds its capture.
+type sniffer struct {
+	fd      int
+	ring    []byte
+	timeout time.Duration
+	traffic *trafficStats
+	capture *pcapWriter
+
+	packets atomic.Int64
+}
+
+// newSniffer opens a packet socket on iface ("any" for every interface),
+// with the filter attached before any packet is received
+func newSniffer(iface string, filter []unix.SockFilter, timeout time.Duration, traffic *trafficStats) (*sniffer, error) {
+	// Protocol 0 receives nothing until the socket is bound below
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, 0)
+	if err != nil {
+		return nil, fmt.Errorf("unix.Socket / %w", err)
+	}
+	s := &sniffer{fd: fd, timeout: timeout, traffic: traffic}
+	if err := s.setup(iface, filter); err != nil {
+		s.close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *sniffer) setup(iface string, filter []unix.SockFilter) error {
+	fprog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	if err := unix.SetsockoptSockFprog(s.fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &fprog); err != nil {
+		return fmt.Errorf("unix.SetsockoptSockFprog / %w", err)
+	}
+
+	if err := unix.SetsockoptInt(s.fd, unix.SOL_PACKET, unix.PACKET_VERSION, unix.TPACKET_V3); err != nil {
+		return fmt.Errorf("unix.SetsockoptInt / %w", err)
+	}
+	req := unix.TpacketReq3{
+		Block_size:     sniffBlockSize,
+		Block_nr:       sniffBlockCount,
+		Frame_size:     sniffFrameSize,
+		Frame_nr:       sniffBlockSize / sniffFrameSize * sniffBlockCount,
+		Retire_blk_tov: uint32(max(s.timeout.Milliseconds(), 1)),
+	}
+	if err := unix.SetsockoptTpacketReq3(s.fd, unix.SOL_PACKET, unix.PACKET_RX_RING, &req); err != nil {
+		return fmt.Errorf("unix.SetsockoptTpacketReq3 / %w", err)
+	}
+	ring, err := unix.Mmap(s.fd, 0, sniffBlockSize*sniffBlockCount, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("unix.Mmap / %w", err)
+	}
+	s.ring = ring
+
+	ifindex := 0
+	if iface != "any" {
+		netIface, err := net.InterfaceByName(iface)
+		if err != nil {
+			return fmt.Errorf("net.InterfaceByName / %w", err)
+		}
+		ifindex = netIface.Index
+	}
+	if err := unix.Bind(s.fd, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: ifindex}); err != nil {
+		return fmt.Errorf("unix.Bind / %w", err)
+	}
+	return nil
+}
+
+// run accounts the packets. Return on socket errors only, or with nil once
+// the capture of a capture-only sniffer is complete.
+func (s *sniffer) run() error {
+	block := 0
+	pfd := []unix.PollFd{{Fd: int32(s.fd), Events: unix.POLLIN | unix.POLLERR}}
+	for {
+		if s.traffic == nil && (s.capture == nil || s.capture.full()) {
+			return nil
+		}
+		if _, err := unix.Poll(pfd, int(s.timeout.Milliseconds())); err != nil && err != unix.EINTR {
+			return fmt.Errorf("unix.Poll / %w", err)
+		}
+
+		// Blocks are handed over by the kernel in order
+		now := time.Now()
+		for {
+			status := s.blockWord(block, blockStatusOffset)
+			if atomic.LoadUint32(status)&unix.TP_STATUS_USER == 0 {
+				break
+			}
+			s.readBlock(block, now)
+			atomic.StoreUint32(status, unix.TP_STATUS_KERNEL)
+			block = (block + 1) % sniffBlockCount
+		}
+	}
+}
+
+// readBlock accounts the packets of a block to their source
+func (s *sniffer) readBlock(block int, now time.Time) {
+	count := *s.blockWord(block, blockPacketsOffset)
+	s.packets.Add(int64(count))
+	base := block * sniffBlockSize
+	offset := base + int(*s.blockWord(block, blockFirstPacketOffset))
+	for i := uint32(0); i < count; i++ {
+		if offset+packetNetOffset+2 > base+sniffBlockSize {
+			return
+		}
+		snaplen := int(*s.word32(offset + packetSnaplenOffset))
+		length := int(*s.word32(offset + packetLenOffset))
+		mac := int(*s.word16(offset + packetMacOffset))
+		network := int(*s.word16(offset + packetNetOffset))
+		start, end := offset+network, offset+mac+snaplen
+		if start < end && end <= base+sniffBlockSize {
+			packet := s.ring[start:end]
+			if src, ok := packetSource(packet); ok && s.traffic != nil {
+				s.traffic.add(src, length, now)
+			}
+			if s.capture != nil {
+				t := time.Unix(int64(*s.word32(offset + packetSecOffset)), int64(*s.word32(offset + packetNsecOffset)))
+				s.capture.write(t, packet, length-(network-mac))
+			}
+		}
+
+		next := int(*s.word32(offset + packetNextOffset))
+		if next == 0 {
+			return
+		}
+		offset += next
+	}
+}
+
+// blockWord return a pointer to the 32 bits word at offset in a block
+// descriptor of the ring
+func (s *sniffer) blockWord(block int, offset int) *uint32 {
+	return s.word32(block*sniffBlockSize + offset)
+}
+
+func (s *sniffer) word32(offset int) *uint32 {
+	return (*uint32)(unsafe.Pointer(&s.ring[offset]))
+}
+
+func (s *sniffer) word16(offset int) *uint16 {
+	return (*uint16)(unsafe.Pointer(&s.ring[offset]))
+}
+
+func (s *sniffer) close() {
+	if s.ring != nil {
+		unix.Munmap(s.ring)
+		s.ring = nil
+	}
+	unix.Close(s.fd)
+}
+
+// htons converts a short to network byte order
+func htons(v uint16) uint16 {
+	b := [2]byte{}
+	binary.BigEndian.PutUint16(b[:], v)
+	return *(*uint16)(unsafe.Pointer(&b[0]))
+}
+
+// GetFirstIfaceWithIps return the first interface that is not a loopback
+// and has an IPv4 or a global IPv6 address, with all such addresses. Hosts
+// may be IPv6 only.
+func GetFirstIfaceWithIps() (string, []net.IP, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", nil, fmt.Errorf("net.Interfaces / %w", err)
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if ips, err := ifaceIPs(iface.Name); err == nil && len(ips) > 0 {
+			return iface.Name, ips, nil
+		}
+	}
+	return "", nil, errors.New("no iface with AF_INET or AF_INET6 address found")
+}
+
+// isHostIP tells if ip is an address clients connect to: IPv4 other than
+// link-local, or global IPv6
+func isHostIP(ip net.IP) bool {
+	if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+		return false
+	}
+	return ip.To4() != nil || ip.IsGlobalUnicast()
+}
+
+// ifaceIPs return the host addresses of an interface
+func ifaceIPs(iface string) ([]net.IP, error) {
+	netIface, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := netIface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	ips := []net.IP{}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && isHostIP(ipNet.IP) {
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	return ips, nil
+}
+
+// withHostFilter restricts filter to the packets sent to any of ips
+func withHostFilter(ips []net.IP, filter string) string {
+	if len(ips) == 0 {
+		return filter
+	}
+	if filter == "" {
+		return hostFilter(ips)
+	}
+	return fmt.Sprintf("(%v) and (%v)", hostFilter(ips), filter)
+}
+
+// hostFilter return a filter matching the packets sent to any of ips
+func hostFilter(ips []net.IP) string {
+	hosts := []string{}
+	for _, ip := range ips {
+		hosts = append(hosts, fmt.Sprintf("dst host %v", ip))
+	}
+	return strings.Join(hosts, " or ")
+}
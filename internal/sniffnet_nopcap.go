@@ -0,0 +1,14 @@
+//go:build !pcap
+
+package internal
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// compilePcapFilter fails, libpcap is only linked with the pcap build tag
+func compilePcapFilter(iface string, filter string, cause error) ([]unix.SockFilter, error) {
+	return nil, fmt.Errorf("%w (build with the pcap tag for libpcap filters)", cause)
+}
@@ -0,0 +1,158 @@
+package internal
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Lines longer than this are passed through in full, but truncated for the
+// scans to bound the memory used
+const maxScannedLineLength = 1 << 20
+
+// Minimum delay between two warnings about dropped lines
+const dropWarningInterval = 10 * time.Second
+
+// outputStream is the read end of a process output, and where it is copied
+type outputStream struct {
+	reader      *os.File
+	passthrough io.Writer
+}
+
+// newOutputPipe returns a pipe whose write end is given to the process. The
+// write end must be closed by the caller once the process started, so that
+// the read end gets EOF when the process exits.
+//
+// This is used instead of exec.Cmd.StdoutPipe, whose read end is closed by
+// exec.Cmd.Wait even if the output is not completely read yet.
+func newOutputPipe(passthrough io.Writer) (outputStream, *os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return outputStream{}, nil, err
+	}
+	return outputStream{reader: r, passthrough: passthrough}, w, nil
+}
+
+// readLines copies r to passthrough as it comes, and calls lineFn for each
+// line, whatever its length. Return nil once r reached EOF.
+func readLines(r io.Reader, passthrough io.Writer, lineFn func(string)) error {
+	reader := bufio.NewReaderSize(r, 64*1024)
+	line := []byte{}
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if len(chunk) > 0 {
+			passthrough.Write(chunk)
+			if room := maxScannedLineLength - len(line); room > 0 {
+				line = append(line, chunk[:min(len(chunk), room)]...)
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			// Long line, read the rest of it
+			continue
+		}
+		if err == nil || len(line) > 0 {
+			lineFn(strings.TrimRight(string(line), "\r\n"))
+			line = line[:0]
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// dropCounter counts the lines a scan dropped because its consumer did not
+// keep up, and warns about them at most every dropWarningInterval
+type dropCounter struct {
+	name     string
+	count    atomic.Int64
+	lastWarn atomic.Int64
+}
+
+func newDropCounter(name string) *dropCounter {
+	return &dropCounter{name: name}
+}
+
+func (d *dropCounter) drop(logger *zap.Logger) {
+	count := d.count.Add(1)
+	now := time.Now().UnixNano()
+	last := d.lastWarn.Load()
+	if now-last >= int64(dropWarningInterval) && d.lastWarn.CompareAndSwap(last, now) {
+		logger.Warn("scanned lines dropped", zap.String("scan", d.name), zap.Int64("dropped", count))
+	}
+}
+
+// trySend sends v on ch without blocking, and counts a drop if ch is full
+func trySend[T any](ch chan<- T, v T, drops *dropCounter, logger *zap.Logger) {
+	select {
+	case ch <- v:
+	default:
+		drops.drop(logger)
+	}
+}
+
+// queue is an unbounded FIFO for the scans that cannot drop a line: push
+// never blocks, so that a slow consumer cannot stall the process either
+type queue[T any] struct {
+	mu     sync.Mutex
+	items  []T
+	closed bool
+	ready  chan struct{}
+}
+
+func newQueue[T any]() *queue[T] {
+	return &queue[T]{ready: make(chan struct{}, 1)}
+}
+
+func (q *queue[T]) push(v T) {
+	q.mu.Lock()
+	q.items = append(q.items, v)
+	q.mu.Unlock()
+	q.signal()
+}
+
+// close ends the queue once its items are consumed
+func (q *queue[T]) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.signal()
+}
+
+func (q *queue[T]) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// pop waits for the next item. Return false once the queue is closed and
+// empty.
+func (q *queue[T]) pop() (T, bool) {
+	for {
+		q.mu.Lock()
+		if len(q.items) > 0 {
+			v := q.items[0]
+			var zero T
+			q.items[0] = zero
+			q.items = q.items[1:]
+			q.mu.Unlock()
+			return v, true
+		}
+		if q.closed {
+			q.mu.Unlock()
+			var zero T
+			return zero, false
+		}
+		q.mu.Unlock()
+		<-q.ready
+	}
+}
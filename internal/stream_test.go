@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// TestScansDoNotBlockOutput floods rule matches while their consumer is
+// stuck, and checks that the output is still passed through in full
+func TestScansDoNotBlockOutput(t *testing.T) {
+	const lines = 5000
+	rule := &Rule{Pattern: `(?P<player>p\d+) joined`, Action: RulePlayerJoin}
+	if err := rule.compile(); err != nil {
+		t.Fatal(err)
+	}
+	watchdog, err := newWatchdog(0, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := Wrapped{
+		logger:    zap.NewNop(),
+		lastLines: newLineRing(10),
+		watchdog:  watchdog,
+		players:   newPlayerSet(),
+		rules:     []*Rule{rule},
+	}
+
+	r, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	passthrough := &bytes.Buffer{}
+	// The consumer of the rules is stuck on the player set
+	w.players.mu.Lock()
+	streamsDone := w.enableStdScans([]outputStream{{reader: r, passthrough: passthrough}}, nil, make(chan struct{}))
+
+	go func() {
+		defer pw.Close()
+		for i := 0; i < lines; i++ {
+			fmt.Fprintf(pw, "p%d joined the game\n", i)
+		}
+	}()
+	select {
+	case <-streamsDone:
+	case <-time.After(5 * time.Second):
+		w.players.mu.Unlock()
+		t.Fatal("output blocked by the rules consumer")
+	}
+	if got := bytes.Count(passthrough.Bytes(), []byte("\n")); got != lines {
+		t.Errorf("%d lines passed through, want %d", got, lines)
+	}
+
+	// No match is lost once the consumer catches up
+	w.players.mu.Unlock()
+	deadline := time.Now().Add(5 * time.Second)
+	for w.players.count() != lines && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := w.players.count(); got != lines {
+		t.Errorf("%d players joined, want %d", got, lines)
+	}
+}
+
+func TestQueue(t *testing.T) {
+	q := newQueue[int]()
+	done := make(chan []int)
+	go func() {
+		got := []int{}
+		for v, ok := q.pop(); ok; v, ok = q.pop() {
+			got = append(got, v)
+		}
+		done <- got
+	}()
+	for i := 0; i < 1000; i++ {
+		q.push(i)
+	}
+	q.close()
+	got := <-done
+	if len(got) != 1000 {
+		t.Fatalf("popped %d items, want 1000", len(got))
+	}
+	for i, v := range got {
+		if v != i {
+			t.Fatalf("item %d = %d, out of order", i, v)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package internal
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// tailer follows a log file by path, like tail -F. It handles:
+//   - files created after the tailer, read from their beginning;
+//   - files existing before the tailer, read from their size at that time,
+//     so that the output of a previous session is not scanned again;
+//   - rotation, detected by an inode change of the path: the old file is
+//     drained, then the new one is read from its beginning;
+//   - truncation, detected by a size smaller than the offset, or by a byte
+//     before the offset that is not the end of the last line read: the file
+//     is read again from its beginning.
+type tailer struct {
+	logger   *zap.Logger
+	path     string
+	interval time.Duration
+
+	file    *os.File
+	inode   uint64
+	offset  int64
+	reader  *bufio.Reader
+	partial string
+	skip    int64
+	// A complete line was read up to the offset. The end of a file existing
+	// before the tailer is not known to be a line end.
+	sawNewline bool
+	// The file existing before the tailer ends with an unterminated line,
+	// whose line end is not a line of this session
+	skipLineEnd bool
+}
+
+func newTailer(logger *zap.Logger, path string, interval time.Duration) *tailer {
+	t := &tailer{
+		logger:   logger,
+		path:     path,
+		interval: interval,
+	}
+	if info, err := os.Stat(path); err == nil {
+		t.skip = info.Size()
+	}
+	return t
+}
+
+// run polls the file and calls lineFn for each complete line, until done is
+// closed
+func (t *tailer) run(done <-chan struct{}, lineFn func(string)) {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	defer t.close()
+
+	for {
+		t.poll(lineFn)
+		select {
+		case <-done:
+			// Last poll to catch the final lines
+			t.poll(lineFn)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (t *tailer) poll(lineFn func(string)) {
+	if t.file == nil {
+		if !t.open() {
+			return
+		}
+	}
+
+	if t.truncated() {
+		t.logger.Debug("tailed file truncated", zap.String("path", t.path))
+		t.file.Seek(0, io.SeekStart)
+		t.reader.Reset(t.file)
+		t.offset = 0
+		t.partial = ""
+		t.sawNewline = false
+		t.skipLineEnd = false
+	}
+
+	t.readLines(lineFn)
+
+	// The path now points to another file: the current one is drained above,
+	// switch to the new one
+	if inode, err := pathInode(t.path); err == nil && inode != t.inode {
+		t.logger.Debug("tailed file rotated", zap.String("path", t.path))
+		t.close()
+		if t.open() {
+			t.readLines(lineFn)
+		}
+	}
+}
+
+func (t *tailer) open() bool {
+	file, err := os.Open(t.path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			t.logger.Error("error in tailer", zap.String("culprit", "os.Open"), zap.String("path", t.path), zap.Error(err))
+		}
+		return false
+	}
+	inode, err := fileInode(file)
+	if err != nil {
+		t.logger.Error("error in tailer", zap.String("culprit", "fileInode"), zap.String("path", t.path), zap.Error(err))
+		file.Close()
+		return false
+	}
+
+	t.offset = 0
+	t.skipLineEnd = false
+	if t.skip > 0 {
+		last := make([]byte, 1)
+		if _, err := file.ReadAt(last, t.skip-1); err == nil && last[0] != '\n' {
+			t.skipLineEnd = true
+		}
+		t.offset, _ = file.Seek(t.skip, io.SeekStart)
+		t.skip = 0
+	}
+	t.file = file
+	t.inode = inode
+	t.reader = bufio.NewReader(file)
+	t.partial = ""
+	t.sawNewline = false
+	t.logger.Debug("tailing file", zap.String("path", t.path), zap.Int64("offset", t.offset))
+	return true
+}
+
+func (t *tailer) truncated() bool {
+	info, err := t.file.Stat()
+	if err != nil {
+		return false
+	}
+	if info.Size() < t.offset {
+		return true
+	}
+	// A file truncated and written again beyond the offset in between two
+	// polls is only caught if this tailer read a complete line last
+	if t.sawNewline && t.partial == "" && t.offset > 0 {
+		last := make([]byte, 1)
+		if _, err := t.file.ReadAt(last, t.offset-1); err == nil && last[0] != '\n' {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *tailer) readLines(lineFn func(string)) {
+	for {
+		chunk, err := t.reader.ReadString('\n')
+		t.offset += int64(len(chunk))
+		if err != nil {
+			// Incomplete line, completed by a next read
+			t.partial += chunk
+			return
+		}
+		line := strings.TrimRight(t.partial+chunk, "\r\n")
+		if !t.skipLineEnd || line != "" {
+			lineFn(line)
+		}
+		t.partial = ""
+		t.sawNewline = true
+		t.skipLineEnd = false
+	}
+}
+
+func (t *tailer) close() {
+	if t.file != nil {
+		t.file.Close()
+		t.file = nil
+	}
+}
+
+func fileInode(file *os.File) (uint64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Sys().(*syscall.Stat_t).Ino, nil
+}
+
+func pathInode(path string) (uint64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Sys().(*syscall.Stat_t).Ino, nil
+}
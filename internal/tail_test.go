@@ -0,0 +1,63 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// pollLines polls the tailer once and return the lines read
+func pollLines(t *tailer) []string {
+	lines := []string{}
+	t.poll(func(line string) { lines = append(lines, line) })
+	return lines
+}
+
+func TestTailerSkipsPreviousSession(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.log")
+	// The previous session did not end its last line
+	if err := os.WriteFile(path, []byte("old line\nserver ready"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tail := newTailer(zap.NewNop(), path, time.Second)
+	defer tail.close()
+
+	if lines := pollLines(tail); len(lines) != 0 {
+		t.Fatalf("first poll read %q, want nothing", lines)
+	}
+	if lines := pollLines(tail); len(lines) != 0 {
+		t.Fatalf("second poll read %q, want nothing", lines)
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// The end of the previous session last line is not a line
+	f.WriteString("\nnew line\n")
+	if lines, want := pollLines(tail), []string{"new line"}; !slices.Equal(lines, want) {
+		t.Fatalf("read %q, want %q", lines, want)
+	}
+}
+
+func TestTailerTruncated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.log")
+	tail := newTailer(zap.NewNop(), path, time.Second)
+	defer tail.close()
+
+	os.WriteFile(path, []byte("first\n"), 0644)
+	if lines, want := pollLines(tail), []string{"first"}; !slices.Equal(lines, want) {
+		t.Fatalf("read %q, want %q", lines, want)
+	}
+
+	// Truncated and written again beyond the offset between two polls
+	os.WriteFile(path, []byte("second line\n"), 0644)
+	if lines, want := pollLines(tail), []string{"second line"}; !slices.Equal(lines, want) {
+		t.Fatalf("read %q, want %q", lines, want)
+	}
+}
@@ -0,0 +1,83 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// templateData is the data available to config templates, e.g.
+//
+//	ServerName={{ .Server }}
+//	PublicIp={{ .PublicIp }}
+//	Password={{ env "SERVER_PASS" }}
+//	MaxPlayers={{ env "MAX_PLAYERS" | default "10" }}
+type templateData struct {
+	Server     string
+	Home       string
+	InstanceId string
+	PublicIp   string
+	Uid        int
+	Gid        int
+	Env        map[string]string
+}
+
+var templateFuncs = template.FuncMap{
+	"env": os.Getenv,
+	"default": func(def string, value string) string {
+		if value == "" {
+			return def
+		}
+		return value
+	},
+}
+
+// parseTemplateSpec parses an entry like "template:destination"
+func parseTemplateSpec(spec string) (string, string, error) {
+	src, dst, found := strings.Cut(spec, ":")
+	if !found || src == "" || dst == "" {
+		return "", "", fmt.Errorf("%v is not a template:destination pair", spec)
+	}
+	return src, dst, nil
+}
+
+func environMap() map[string]string {
+	env := map[string]string{}
+	for _, kv := range os.Environ() {
+		k, v, _ := strings.Cut(kv, "=")
+		env[k] = v
+	}
+	return env
+}
+
+// renderTemplate renders the src template to dst, creating the missing
+// directories. The destination keeps the mode of the template.
+func renderTemplate(src string, dst string, data templateData, uid int, gid int) error {
+	tmpl, err := template.New(filepath.Base(src)).Funcs(templateFuncs).Option("missingkey=error").ParseFiles(src)
+	if err != nil {
+		return fmt.Errorf("ParseFiles / %w", err)
+	}
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return fmt.Errorf("os.Stat / %w", err)
+	}
+
+	if err := mkdirAllChown(filepath.Dir(dst), os.ModePerm, uid, gid); err != nil {
+		return fmt.Errorf("mkdirAllChown / %w", err)
+	}
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, srcInfo.Mode().Perm())
+	if err != nil {
+		return fmt.Errorf("os.OpenFile / %w", err)
+	}
+	defer func() {
+		f.Close()
+		os.Chown(dst, uid, gid)
+	}()
+
+	if err := tmpl.Execute(f, data); err != nil {
+		return fmt.Errorf("Execute / %w", err)
+	}
+	return nil
+}
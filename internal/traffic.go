@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Maximum number of sources tracked, so that a flood of spoofed addresses
+// cannot exhaust the memory. Sources beyond are not counted.
+const maxTrafficSources = 4096
+
+// trafficStats counts the packets and bytes of each source IP over a
+// sliding window, in one second buckets
+type trafficStats struct {
+	mu      sync.Mutex
+	window  time.Duration
+	sources map[netip.Addr][]trafficBucket
+}
+
+type trafficBucket struct {
+	second  int64
+	packets int64
+	bytes   int64
+}
+
+// NetworkActivity is published by the sniffer when enough clients are active
+type NetworkActivity struct {
+	Time    time.Time
+	Clients int
+	Packets int64
+	Bytes   int64
+}
+
+func newTrafficStats(window time.Duration) *trafficStats {
+	return &trafficStats{
+		window:  max(window, time.Second),
+		sources: map[netip.Addr][]trafficBucket{},
+	}
+}
+
+func (t *trafficStats) add(src netip.Addr, bytes int, now time.Time) {
+	t.addCount(src, 1, int64(bytes), now)
+}
+
+// addCount accounts several packets at once, for sources that only give
+// counters
+func (t *trafficStats) addCount(src netip.Addr, packets int64, bytes int64, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	buckets, ok := t.sources[src]
+	if !ok && len(t.sources) >= maxTrafficSources {
+		return
+	}
+	second := now.Unix()
+	if n := len(buckets); n > 0 && buckets[n-1].second == second {
+		buckets[n-1].packets += packets
+		buckets[n-1].bytes += bytes
+		return
+	}
+	t.sources[src] = append(buckets, trafficBucket{second: second, packets: packets, bytes: bytes})
+}
+
+// activity drops the buckets out of the window, and counts the clients that
+// sent at least minPps packets per second on average over the window
+func (t *trafficStats) activity(now time.Time, minPps float64) NetworkActivity {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	activity := NetworkActivity{Time: now}
+	oldest := now.Add(-t.window).Unix()
+	for src, buckets := range t.sources {
+		start := 0
+		for start < len(buckets) && buckets[start].second <= oldest {
+			start++
+		}
+		if start == len(buckets) {
+			delete(t.sources, src)
+			continue
+		}
+		buckets = buckets[start:]
+		t.sources[src] = buckets
+
+		packets, bytes := int64(0), int64(0)
+		for _, bucket := range buckets {
+			packets += bucket.packets
+			bytes += bucket.bytes
+		}
+		activity.Packets += packets
+		activity.Bytes += bytes
+		if float64(packets)/t.window.Seconds() >= minPps {
+			activity.Clients++
+		}
+	}
+	return activity
+}
+
+// packetSource return the source address of an IPv4 or IPv6 packet
+func packetSource(packet []byte) (netip.Addr, bool) {
+	if len(packet) < 1 {
+		return netip.Addr{}, false
+	}
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) >= 16 {
+			return netip.AddrFrom4([4]byte(packet[12:16])), true
+		}
+	case 6:
+		if len(packet) >= 24 {
+			return netip.AddrFrom16([16]byte(packet[8:24])), true
+		}
+	}
+	return netip.Addr{}, false
+}
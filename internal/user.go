@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const passwdFile = "/etc/passwd"
+const groupFile = "/etc/group"
+
+// account is the identity the process runs with
+type account struct {
+	Name   string
+	Uid    int
+	Gid    int
+	Home   string
+	Groups []uint32
+}
+
+// lookupAccount resolves a user name (or numeric uid) from /etc/passwd and
+// its supplementary groups from /etc/group. The files are parsed directly so
+// that the static build does not depend on NSS.
+func lookupAccount(name string) (account, error) {
+	acc := account{}
+	found := false
+	err := scanColonFile(passwdFile, func(fields []string) bool {
+		// name:password:uid:gid:gecos:home:shell
+		if len(fields) < 7 || (fields[0] != name && fields[2] != name) {
+			return true
+		}
+		uid, err1 := strconv.Atoi(fields[2])
+		gid, err2 := strconv.Atoi(fields[3])
+		if err1 != nil || err2 != nil {
+			return true
+		}
+		acc = account{Name: fields[0], Uid: uid, Gid: gid, Home: fields[5]}
+		found = true
+		return false
+	})
+	if err != nil {
+		return acc, fmt.Errorf("scanColonFile %v / %w", passwdFile, err)
+	}
+	if !found {
+		return acc, fmt.Errorf("user %v not found in %v", name, passwdFile)
+	}
+
+	acc.Groups = []uint32{uint32(acc.Gid)}
+	err = scanColonFile(groupFile, func(fields []string) bool {
+		// name:password:gid:members
+		if len(fields) < 4 {
+			return true
+		}
+		gid, err := strconv.Atoi(fields[2])
+		if err != nil || gid == acc.Gid {
+			return true
+		}
+		for _, member := range strings.Split(fields[3], ",") {
+			if member == acc.Name {
+				acc.Groups = append(acc.Groups, uint32(gid))
+				break
+			}
+		}
+		return true
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return acc, fmt.Errorf("scanColonFile %v / %w", groupFile, err)
+	}
+
+	return acc, nil
+}
+
+// scanColonFile calls fn with the fields of each entry of a colon separated
+// file like /etc/passwd, until fn return false
+func scanColonFile(path string, fn func(fields []string) bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !fn(strings.Split(line, ":")) {
+			break
+		}
+	}
+	return scanner.Err()
+}
+
+// accountEnviron return env with HOME, USER and LOGNAME set for the account
+func accountEnviron(env []string, acc account) []string {
+	overrides := map[string]string{
+		"HOME":    acc.Home,
+		"USER":    acc.Name,
+		"LOGNAME": acc.Name,
+	}
+	result := []string{}
+	for _, kv := range env {
+		k, _, _ := strings.Cut(kv, "=")
+		if _, ok := overrides[k]; !ok {
+			result = append(result, kv)
+		}
+	}
+	for k, v := range overrides {
+		result = append(result, k+"="+v)
+	}
+	return result
+}
@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"fmt"
+	"regexp"
+	"sync/atomic"
+	"time"
+)
+
+// watchdog tells whether the process hangs, from the time of its last output
+// and the responses to the liveness probes written on its stdin
+type watchdog struct {
+	silenceTimeout  time.Duration
+	livenessPattern *regexp.Regexp
+	livenessTimeout time.Duration
+
+	lastOutput atomic.Int64
+	probeSent  atomic.Int64
+	probeReply atomic.Int64
+}
+
+func newWatchdog(silenceTimeout time.Duration, livenessPattern string, livenessTimeout time.Duration) (*watchdog, error) {
+	d := &watchdog{
+		silenceTimeout:  silenceTimeout,
+		livenessTimeout: livenessTimeout,
+	}
+	if livenessPattern != "" {
+		re, err := regexp.Compile(livenessPattern)
+		if err != nil {
+			return nil, fmt.Errorf("regexp.Compile / %w", err)
+		}
+		d.livenessPattern = re
+	}
+	d.reset()
+	return d, nil
+}
+
+// reset forgets the previous process, when a new one is started
+func (d *watchdog) reset() {
+	d.lastOutput.Store(time.Now().UnixNano())
+	d.probeSent.Store(0)
+	d.probeReply.Store(0)
+}
+
+// observe records a line of output, and whether it answers a probe
+func (d *watchdog) observe(line string) {
+	now := time.Now().UnixNano()
+	d.lastOutput.Store(now)
+	if d.livenessPattern != nil && d.probeSent.Load() > d.probeReply.Load() && d.livenessPattern.MatchString(line) {
+		d.probeReply.Store(now)
+	}
+}
+
+// probed records that a probe was written, unless one is still unanswered
+func (d *watchdog) probed() {
+	if d.probeSent.Load() <= d.probeReply.Load() {
+		d.probeSent.Store(time.Now().UnixNano())
+	}
+}
+
+// hung return why the process is deemed hung. Output silence only counts
+// when busy, as many servers are quiet when nobody plays.
+func (d *watchdog) hung(busy bool) (string, bool) {
+	now := time.Now()
+	if d.silenceTimeout > 0 && busy {
+		if silence := now.Sub(time.Unix(0, d.lastOutput.Load())); silence > d.silenceTimeout {
+			return fmt.Sprintf("no output for %v", silence.Round(time.Second)), true
+		}
+	}
+	if sent := d.probeSent.Load(); sent > d.probeReply.Load() {
+		if wait := now.Sub(time.Unix(0, sent)); wait > d.livenessTimeout {
+			return fmt.Sprintf("no liveness response for %v", wait.Round(time.Second)), true
+		}
+	}
+	return "", false
+}
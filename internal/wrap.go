@@ -1,30 +1,72 @@
 package internal
 
 import (
-	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net/netip"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/caarlos0/env"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"golang.org/x/sys/unix"
+)
+
+// Actions taken when the server is not ready after LSDC2_READY_TIMEOUT
+const (
+	ReadyActionStop    = "stop"
+	ReadyActionRestart = "restart"
+	ReadyActionWait    = "wait"
 )
 
 type Wrapped struct {
 	logger       *zap.Logger
 	cl           []string
-	cmd          *exec.Cmd
+	runMu        *sync.Mutex
+	run          processRun
 	sigWith      os.Signal
-	processStart time.Time
-	iface        string
+	processExit  time.Time
+	sniffTargets []sniffTarget
+	activity     chan NetworkActivity
+	activePorts  map[uint16]bool
+	capture      *pcapWriter
+	unmatched    *pcapWriter
+	reaper       *reaper
+	console      *console
+	stdin        io.WriteCloser
+	watchdog     *watchdog
+	lag          *lagDetector
+	cgroupDir    string
+	account      *account
+	rules        []*Rule
+	players      *playerSet
+	saveMu       *sync.Mutex
+	stopRequests chan string
+	readyC       chan struct{}
+	lastLines    *lineRing
+	outputFile   *rotatingFile
+	outputDone   chan struct{}
+	sessionStart time.Time
+	logDrops     *dropCounter
+	outputDrops  *dropCounter
+	lagDrops     *dropCounter
+	stopMu       *sync.Mutex
+	stopReason   StopReason
+	stopping     bool
+	queryNow     chan chan *serverInfo
+
+	forwardedSignals map[os.Signal]os.Signal
 
 	Home string `env:"LSDC2_HOME"`
+	User string `env:"LSDC2_USER"`
 	Uid  int    `env:"LSDC2_UID"`
 	Gid  int    `env:"LSDC2_GID"`
 
@@ -33,28 +75,95 @@ type Wrapped struct {
 	Bucket       string   `env:"LSDC2_BUCKET"`
 	Server       string   `env:"LSDC2_SERVER"`
 	Zip          bool     `env:"LSDC2_ZIP"`
+	CrashReport  bool     `env:"LSDC2_CRASH_REPORT" envDefault:"true"`
 	ZipFrom      string   `env:"LSDC2_ZIPFROM"`
+	Templates    []string `env:"LSDC2_TEMPLATES" envSeparator:";"`
 
 	InEc2Instance            bool
 	CloudWatchLogGroup       string        `env:"LSDC2_LOG_GROUP"`
 	CloudWatchFlushInterval  time.Duration `env:"LSDC2_LOG_FLUSH_INTERVAL" envDefault:"5s"`
 	TerminationCheckInterval time.Duration `env:"LSDC2_TERMINATION_CHECK_INTERVAL" envDefault:"10s"`
 	SignalGraceDelay         time.Duration `env:"LSDC2_SIGNAL_GRACE_DELAY" envDefault:"20s"`
+	ActivitySource           string        `env:"LSDC2_ACTIVITY_SOURCE" envDefault:"sniff"`
+	ActivityPorts            []string      `env:"LSDC2_ACTIVITY_PORTS" envSeparator:";"`
+	SniffIfaces              []string      `env:"LSDC2_SNIFF_IFACE" envSeparator:";"`
 	SniffFilter              string        `env:"LSDC2_SNIFF_FILTER"`
 	SniffTimeout             time.Duration `env:"LSDC2_SNIFF_TIMEOUT" envDefault:"1s"`
 	SniffInterval            time.Duration `env:"LSDC2_SNIFF_INTERVAL" envDefault:"10s"`
 	EmptyTimeout             time.Duration `env:"LSDC2_EMPTY_TIMEOUT" envDefault:"5m"`
+	ClientWindow             time.Duration `env:"LSDC2_CLIENT_WINDOW" envDefault:"30s"`
+	ClientMinCount           int           `env:"LSDC2_CLIENT_MIN_COUNT" envDefault:"1"`
+	ClientMinPps             float64       `env:"LSDC2_CLIENT_MIN_PPS" envDefault:"0"`
+	SniffCapture             string        `env:"LSDC2_SNIFF_CAPTURE"`
+	SniffCaptureCount        int           `env:"LSDC2_SNIFF_CAPTURE_COUNT" envDefault:"1000"`
+	SniffCaptureUnmatched    bool          `env:"LSDC2_SNIFF_CAPTURE_UNMATCHED" envDefault:"false"`
+
+	ScanStderr     bool          `env:"LSDC2_SCAN_STDERR" envDefault:"false"`
+	ScanStdout     bool          `env:"LSDC2_SCAN_STDOUT" envDefault:"false"`
+	ScanFiles      []string      `env:"LSDC2_SCAN_FILES" envSeparator:";"`
+	ScanFilesPoll  time.Duration `env:"LSDC2_SCAN_FILES_POLL" envDefault:"500ms"`
+	WakeupSentinel string        `env:"LSDC2_WAKEUP_SENTINEL"`
+	LogScans       bool          `env:"LSDC2_LOG_SCANS" envDefault:"false"`
+	LogFilter      []string      `env:"LSDC2_LOG_FILTER" envSeparator:";"`
+	LogFormat      string        `env:"LSDC2_LOG_FORMAT" envDefault:"text"`
+	RulesFile      string        `env:"LSDC2_RULES_FILE"`
+	LastLines      int           `env:"LSDC2_LAST_LINES" envDefault:"50"`
+
+	OutputDir        string        `env:"LSDC2_OUTPUT_DIR"`
+	OutputMaxSizeMiB int64         `env:"LSDC2_OUTPUT_MAX_SIZE_MB" envDefault:"10"`
+	OutputMaxAge     time.Duration `env:"LSDC2_OUTPUT_MAX_AGE" envDefault:"1h"`
+	OutputUpload     bool          `env:"LSDC2_OUTPUT_UPLOAD" envDefault:"true"`
+
+	ReadyTimeout       time.Duration `env:"LSDC2_READY_TIMEOUT" envDefault:"0"`
+	ReadyTimeoutAction string        `env:"LSDC2_READY_TIMEOUT_ACTION" envDefault:"stop"`
+	ReadyMaxRestarts   int           `env:"LSDC2_READY_MAX_RESTARTS" envDefault:"2"`
+
+	HangTimeout      time.Duration `env:"LSDC2_HANG_TIMEOUT" envDefault:"0"`
+	HangMaxRestarts  int           `env:"LSDC2_HANG_MAX_RESTARTS" envDefault:"3"`
+	LivenessCommand  string        `env:"LSDC2_LIVENESS_COMMAND"`
+	LivenessPattern  string        `env:"LSDC2_LIVENESS_PATTERN"`
+	LivenessInterval time.Duration `env:"LSDC2_LIVENESS_INTERVAL" envDefault:"1m"`
+	LivenessTimeout  time.Duration `env:"LSDC2_LIVENESS_TIMEOUT" envDefault:"10s"`
 
-	ScanStderr     bool     `env:"LSDC2_SCAN_STDERR" envDefault:"false"`
-	ScanStdout     bool     `env:"LSDC2_SCAN_STDOUT" envDefault:"false"`
-	WakeupSentinel string   `env:"LSDC2_WAKEUP_SENTINEL"`
-	LogScans       bool     `env:"LSDC2_LOG_SCANS" envDefault:"false"`
-	LogFilter      []string `env:"LSDC2_LOG_FILTER" envSeparator:";"`
+	LagThreshold       int           `env:"LSDC2_LAG_THRESHOLD" envDefault:"0"`
+	LagWindow          time.Duration `env:"LSDC2_LAG_WINDOW" envDefault:"5m"`
+	LagWarningInterval time.Duration `env:"LSDC2_LAG_WARNING_INTERVAL" envDefault:"30m"`
+	LagPatterns        []string      `env:"LSDC2_LAG_PATTERNS" envSeparator:";"`
+	LagBuiltinPatterns bool          `env:"LSDC2_LAG_BUILTIN_PATTERNS" envDefault:"true"`
+
+	PlayerJoinPattern  string `env:"LSDC2_PLAYER_JOIN_PATTERN"`
+	PlayerLeavePattern string `env:"LSDC2_PLAYER_LEAVE_PATTERN"`
+
+	QueryProtocol string        `env:"LSDC2_QUERY_PROTOCOL"`
+	QueryAddress  string        `env:"LSDC2_QUERY_ADDRESS"`
+	QueryInterval time.Duration `env:"LSDC2_QUERY_INTERVAL" envDefault:"30s"`
+	QueryTimeout  time.Duration `env:"LSDC2_QUERY_TIMEOUT" envDefault:"2s"`
 
 	LowMemoryWarningThresholdMiB int64         `env:"LSDC2_LOW_MEMORY_WARNING_MB" envDefault:"0"`
 	LowMemorySignalThresholdMiB  int64         `env:"LSDC2_LOW_MEMORY_SIGNAL_MB" envDefault:"0"`
 	LowMemoryCheckInterval       time.Duration `env:"LSDC2_LOW_MEMORY_CHECK_INTERVAL" envDefault:"5s"`
 
+	Console       bool   `env:"LSDC2_CONSOLE" envDefault:"false"`
+	ConsoleSocket string `env:"LSDC2_CONSOLE_SOCKET"`
+
+	Cgroup           bool   `env:"LSDC2_CGROUP" envDefault:"false"`
+	CgroupName       string `env:"LSDC2_CGROUP_NAME" envDefault:"game"`
+	CgroupMemoryMax  string `env:"LSDC2_CGROUP_MEMORY_MAX"`
+	CgroupMemoryHigh string `env:"LSDC2_CGROUP_MEMORY_HIGH"`
+	CgroupCpuMax     string `env:"LSDC2_CGROUP_CPU_MAX"`
+	CgroupPidsMax    string `env:"LSDC2_CGROUP_PIDS_MAX"`
+
+	HookAfterRestore   string        `env:"LSDC2_HOOK_AFTER_RESTORE"`
+	HookBeforeStart    string        `env:"LSDC2_HOOK_BEFORE_START"`
+	HookOnReady        string        `env:"LSDC2_HOOK_ON_READY"`
+	HookBeforeSave     string        `env:"LSDC2_HOOK_BEFORE_SAVE"`
+	HookAfterSave      string        `env:"LSDC2_HOOK_AFTER_SAVE"`
+	HookBeforeShutdown string        `env:"LSDC2_HOOK_BEFORE_SHUTDOWN"`
+	HookTimeout        time.Duration `env:"LSDC2_HOOK_TIMEOUT" envDefault:"30s"`
+
+	Subreaper      bool     `env:"LSDC2_SUBREAPER" envDefault:"false"`
+	ForwardSignals []string `env:"LSDC2_FORWARD_SIGNALS" envSeparator:";"`
+
 	PanicOnSocketError   bool `env:"PANIC_ON_SOCKET_ERROR" envDefault:"true"`
 	DisableShutdownCalls bool `env:"DISABLE_SHUTDOWN_CALLS" envDefault:"false"`
 }
@@ -78,14 +187,141 @@ func NewWrapped(logger *zap.Logger, cl []string) Wrapped {
 	if w.EmptyTimeout == 0 {
 		w.EmptyTimeout = 5 * time.Minute
 	}
+	if w.ScanFilesPoll == 0 {
+		w.ScanFilesPoll = 500 * time.Millisecond
+	}
+	if w.ConsoleSocket == "" {
+		w.ConsoleSocket = DefaultConsoleSocket
+	}
+	switch w.LogFormat {
+	case LogFormatText, LogFormatJson, LogFormatLogfmt:
+	case "":
+		w.LogFormat = LogFormatText
+	default:
+		panic(fmt.Errorf("unknown LSDC2_LOG_FORMAT %v", w.LogFormat))
+	}
+	switch w.ActivitySource {
+	case ActivitySourceSniff, ActivitySourceProc, ActivitySourceConntrack:
+	case "":
+		w.ActivitySource = ActivitySourceSniff
+	default:
+		panic(fmt.Errorf("unknown LSDC2_ACTIVITY_SOURCE %v", w.ActivitySource))
+	}
+	if w.activePorts, err = parseActivityPorts(w.ActivityPorts); err != nil {
+		panic(err)
+	}
+	switch w.ReadyTimeoutAction {
+	case ReadyActionStop, ReadyActionRestart, ReadyActionWait:
+	case "":
+		w.ReadyTimeoutAction = ReadyActionStop
+	default:
+		panic(fmt.Errorf("unknown LSDC2_READY_TIMEOUT_ACTION %v", w.ReadyTimeoutAction))
+	}
+	if w.LastLines < 0 {
+		panic(fmt.Errorf("LSDC2_LAST_LINES must not be negative, got %d", w.LastLines))
+	}
+	if w.HookTimeout == 0 {
+		w.HookTimeout = 30 * time.Second
+	}
+	switch w.QueryProtocol {
+	case "":
+	case QueryProtocolA2S, QueryProtocolMinecraft, QueryProtocolGameSpy4:
+		if w.QueryAddress == "" {
+			panic(fmt.Errorf("LSDC2_QUERY_ADDRESS is required with LSDC2_QUERY_PROTOCOL"))
+		}
+	default:
+		panic(fmt.Errorf("unknown LSDC2_QUERY_PROTOCOL %v", w.QueryProtocol))
+	}
+	if w.QueryInterval == 0 {
+		w.QueryInterval = 30 * time.Second
+	}
+	if w.QueryTimeout == 0 {
+		w.QueryTimeout = 2 * time.Second
+	}
+	if w.LivenessInterval == 0 {
+		w.LivenessInterval = time.Minute
+	}
+	if (w.LivenessCommand == "") != (w.LivenessPattern == "") {
+		panic(fmt.Errorf("LSDC2_LIVENESS_COMMAND and LSDC2_LIVENESS_PATTERN must be set together"))
+	}
+	if w.LagThreshold > 0 {
+		if w.LagWindow == 0 {
+			w.LagWindow = 5 * time.Minute
+		}
+		if w.LagWarningInterval == 0 {
+			w.LagWarningInterval = 30 * time.Minute
+		}
+		if w.lag, err = newLagDetector(w.LagBuiltinPatterns, w.LagPatterns, w.LagWindow, w.LagThreshold, w.LagWarningInterval); err != nil {
+			panic(err)
+		}
+	}
+	if w.watchdog, err = newWatchdog(w.HangTimeout, w.LivenessPattern, w.LivenessTimeout); err != nil {
+		panic(err)
+	}
 
 	w.Zip = w.Zip || len(w.PersistFiles) > 1
 
+	if w.RulesFile != "" {
+		if w.rules, err = loadRules(w.RulesFile); err != nil {
+			panic(err)
+		}
+	}
+	for action, pattern := range map[string]string{
+		RulePlayerJoin:  w.PlayerJoinPattern,
+		RulePlayerLeave: w.PlayerLeavePattern,
+	} {
+		if pattern == "" {
+			continue
+		}
+		rule := &Rule{Pattern: pattern, Action: action}
+		if err = rule.compile(); err != nil {
+			panic(err)
+		}
+		w.rules = append(w.rules, rule)
+	}
+
+	// A named user takes precedence over numeric ids, so that restored
+	// files are owned by the same identity as the process
+	if w.User != "" {
+		acc, err := lookupAccount(w.User)
+		if err != nil {
+			panic(err)
+		}
+		w.Uid = acc.Uid
+		w.Gid = acc.Gid
+		w.account = &acc
+	}
+
+	if w.forwardedSignals, err = parseForwardSignals(w.ForwardSignals); err != nil {
+		panic(err)
+	}
+
 	w.logger = logger
 	w.cl = cl
 	w.sigWith = syscall.SIGTERM
+	w.reaper = newReaper()
+	w.saveMu = &sync.Mutex{}
+	w.stopMu = &sync.Mutex{}
+	w.runMu = &sync.Mutex{}
+	w.queryNow = make(chan chan *serverInfo, 1)
+	w.stopRequests = make(chan string, 1)
+	w.players = newPlayerSet()
+	w.readyC = make(chan struct{}, 1)
+	w.activity = make(chan NetworkActivity, 1)
+	w.lastLines = newLineRing(w.LastLines)
+	w.logDrops = newDropCounter("log")
+	w.outputDrops = newDropCounter("output")
+	w.lagDrops = newDropCounter("lag")
 	w.InEc2Instance = AreWeRunningEc2()
 
+	w.sessionStart = time.Now()
+	if w.OutputDir != "" {
+		prefix := "output-" + w.sessionStart.UTC().Format("20060102T150405Z")
+		if w.outputFile, err = newRotatingFile(w.OutputDir, prefix, w.OutputMaxSizeMiB<<20, w.OutputMaxAge); err != nil {
+			panic(err)
+		}
+	}
+
 	return w
 }
 
@@ -115,20 +351,48 @@ func (w *Wrapped) NewEc2CloudWatchTeeLogger(logger *zap.Logger) (*zap.Logger, er
 	return w.logger, nil
 }
 
+// sniffTarget is an interface to sniff, with its filter
+type sniffTarget struct {
+	iface  string
+	filter string
+}
+
+// DetectIfaceAndAddHostFilter sets the interfaces to sniff, from
+// LSDC2_SNIFF_IFACE or else the first interface with a host address. The
+// filter of each interface is restricted to the packets sent to its
+// addresses.
 func (w *Wrapped) DetectIfaceAndAddHostFilter() {
-	if iface, ip, err := GetFirstIfaceWithIp4(); err == nil {
-		w.logger.Debug("found iface", zap.String("iface", iface), zap.String("ip", ip.String()))
-		filterWithDest := fmt.Sprintf("dst host %v", ip)
-		if w.SniffFilter != "" {
-			filterWithDest = fmt.Sprintf("(%v) and (%v)", filterWithDest, w.SniffFilter)
-		}
-		w.iface = iface
-		w.SniffFilter = filterWithDest
-	} else {
-		w.logger.Debug("iface not found, using 'any'", zap.Error(err))
-		w.iface = "any"
+	if len(w.SniffIfaces) == 0 {
+		if iface, ips, err := GetFirstIfaceWithIps(); err == nil {
+			w.logger.Debug("found iface", zap.String("iface", iface), zap.Any("ips", ips))
+			w.sniffTargets = []sniffTarget{{iface: iface, filter: withHostFilter(ips, w.SniffFilter)}}
+		} else {
+			w.logger.Debug("iface not found, using 'any'", zap.Error(err))
+			w.sniffTargets = []sniffTarget{{iface: "any", filter: w.SniffFilter}}
+		}
+	}
+
+	// Entries are "iface" or "iface=filter", the filter replacing
+	// LSDC2_SNIFF_FILTER for that interface
+	for _, entry := range w.SniffIfaces {
+		iface, filter, found := strings.Cut(entry, "=")
+		iface = strings.TrimSpace(iface)
+		if !found {
+			filter = w.SniffFilter
+		}
+		if iface != "any" {
+			ips, err := ifaceIPs(iface)
+			if err != nil {
+				w.logger.Error("error in DetectIfaceAndAddHostFilter", zap.String("culprit", "ifaceIPs"), zap.String("iface", iface), zap.Error(err))
+			}
+			filter = withHostFilter(ips, filter)
+		}
+		w.sniffTargets = append(w.sniffTargets, sniffTarget{iface: iface, filter: filter})
+	}
+
+	for _, target := range w.sniffTargets {
+		w.logger.Debug("final BPF filter", zap.String("iface", target.iface), zap.String("filter", target.filter))
 	}
-	w.logger.Debug("final BPF filter", zap.String("filter", w.SniffFilter))
 }
 
 func (w *Wrapped) StartProcess() {
@@ -142,132 +406,1015 @@ func (w *Wrapped) StartProcess() {
 			w.logger.Info("S3 download done !")
 			w.NotifyBackend("info", "Savegame restored from S3")
 		}
+		if err := w.runHook(PhaseAfterRestore); err != nil {
+			w.NotifyBackend("error", "Server start aborted by after-restore hook")
+			w.logger.Panic("error in StartProcess", zap.String("culprit", "runHook"), zap.String("phase", PhaseAfterRestore), zap.Error(err))
+		}
 	}
 
+	if len(w.Templates) > 0 {
+		w.logger.Info("rendering templates")
+		if err := w.renderTemplates(); err != nil {
+			w.NotifyBackend("error", "Server configuration could not be rendered")
+			w.logger.Panic("error in StartProcess", zap.String("culprit", "renderTemplates"), zap.Error(err))
+		}
+	}
+
+	if err := w.runHook(PhaseBeforeStart); err != nil {
+		w.NotifyBackend("error", "Server start aborted by before-start hook")
+		w.logger.Panic("error in StartProcess", zap.String("culprit", "runHook"), zap.String("phase", PhaseBeforeStart), zap.Error(err))
+	}
+
+	w.launchProcess()
+}
+
+// RestartProcess stops the process without grace delay, saves the data if
+// asked, and starts the process again without restoring the savegame. The
+// process is killed if it does not exit within the grace delay, as it may
+// hang.
+func (w *Wrapped) RestartProcess(save bool) {
+	w.logger.Info("restarting process")
+	run := w.currentRun()
+	run.cmd.Process.Signal(w.sigWith)
+	select {
+	case <-run.exited:
+	case <-time.After(w.SignalGraceDelay):
+		w.logger.Warn("process did not exit, killing it")
+		run.cmd.Process.Kill()
+		<-run.exited
+	}
+	w.logger.Info("process exited", zap.Int("exitCode", w.ProcessExitCode()))
+	if save && len(w.PersistFiles) > 0 {
+		w.saveData()
+	}
+	w.launchProcess()
+}
+
+// launchProcess starts the process and its output scans
+func (w *Wrapped) launchProcess() {
+	// Players of a previous process are gone with it
+	if count := w.players.count(); count > 0 {
+		w.logger.Info("players reset", zap.Int("players", count))
+	}
+	w.players.reset()
+
 	w.logger.Debug("cmd initialisation", zap.Strings("cl", w.cl))
-	w.cmd = exec.Command(w.cl[0], w.cl[1:]...)
-	scannedStreams := []io.ReadCloser{}
+	cmd := exec.Command(w.cl[0], w.cl[1:]...)
+	scannedStreams := []outputStream{}
+	processEnds := []*os.File{}
 	if w.Home != "" {
 		w.logger.Debug("set cmd working directory", zap.String("cwd", w.Home))
-		w.cmd.Dir = w.Home
+		cmd.Dir = w.Home
 	}
 	if (w.Uid != 0) || (w.Gid != 0) {
 		w.logger.Debug("set cmd uid/gid", zap.Int("uid", w.Uid), zap.Int("gid", w.Gid))
-		w.cmd.SysProcAttr = &syscall.SysProcAttr{}
-		w.cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(w.Uid), Gid: uint32(w.Gid)}
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(w.Uid), Gid: uint32(w.Gid)}
+		if w.account != nil {
+			cmd.SysProcAttr.Credential.Groups = w.account.Groups
+		}
+	}
+	if w.account != nil {
+		w.logger.Debug("set cmd user environment", zap.String("user", w.account.Name), zap.String("home", w.account.Home), zap.Any("groups", w.account.Groups))
+		cmd.Env = accountEnviron(os.Environ(), *w.account)
+	}
+	if w.Cgroup {
+		cgroup, err := w.setupCgroup(cmd)
+		if err != nil {
+			w.logger.Error("error in StartProcess", zap.String("culprit", "setupCgroup"), zap.Error(err))
+			w.NotifyBackend("error", "Server started without resource limits")
+		} else {
+			defer cgroup.Close()
+		}
 	}
+	// The output is always copied to the wrapper own output, so that it
+	// shows in the container logs even when it is scanned
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
 	if w.ScanStderr {
 		w.logger.Debug("get cmd stderr stream")
-		stream, err := w.cmd.StderrPipe()
+		stream, processEnd, err := newOutputPipe(os.Stderr)
 		if err != nil {
-			w.logger.Panic("error in StartProcess", zap.String("culprit", "StderrPipe"), zap.Error(err))
+			w.logger.Panic("error in StartProcess", zap.String("culprit", "newOutputPipe"), zap.Error(err))
 		}
+		cmd.Stderr = processEnd
+		processEnds = append(processEnds, processEnd)
 		scannedStreams = append(scannedStreams, stream)
 	}
 	if w.ScanStdout {
 		w.logger.Debug("get cmd stdout stream")
-		stream, err := w.cmd.StdoutPipe()
+		stream, processEnd, err := newOutputPipe(os.Stdout)
 		if err != nil {
-			w.logger.Panic("error in StartProcess", zap.String("culprit", "StdoutPipe"), zap.Error(err))
+			w.logger.Panic("error in StartProcess", zap.String("culprit", "newOutputPipe"), zap.Error(err))
 		}
+		cmd.Stdout = processEnd
+		processEnds = append(processEnds, processEnd)
 		scannedStreams = append(scannedStreams, stream)
 	}
+	scannedFiles := []*tailer{}
+	for _, path := range w.ScanFiles {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(w.Home, path)
+		}
+		w.logger.Debug("tail file", zap.String("path", path))
+		scannedFiles = append(scannedFiles, newTailer(w.logger, path, w.ScanFilesPoll))
+	}
+	if w.Console || w.LivenessCommand != "" {
+		w.logger.Debug("get cmd stdin stream")
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			w.logger.Panic("error in StartProcess", zap.String("culprit", "StdinPipe"), zap.Error(err))
+		}
+		w.stdin = stdin
+	}
+	if w.LivenessCommand != "" && len(scannedStreams) == 0 && len(scannedFiles) == 0 {
+		w.logger.Warn("liveness probe enabled without std scan, responses will not be seen")
+	}
+	if w.Console {
+		stdin := w.stdin
+		var err error
+		if len(scannedStreams) == 0 && len(scannedFiles) == 0 {
+			w.logger.Warn("console enabled without std scan, the process output will not be streamed")
+		}
+		if w.console != nil {
+			w.console.setStdin(stdin)
+		} else if w.console, err = newConsole(w.logger, w.ConsoleSocket, stdin); err != nil {
+			w.logger.Error("error in StartProcess", zap.String("culprit", "newConsole"), zap.Error(err))
+			w.NotifyBackend("error", "Console could not be opened")
+		} else {
+			w.logger.Info("console listening", zap.String("socket", w.ConsoleSocket))
+		}
+	}
+	exited := make(chan struct{})
+	w.watchdog.reset()
 	w.logger.Debug("start cmd")
-	if err := w.cmd.Start(); err != nil {
+	if err := w.reaper.startManaged(cmd); err != nil {
 		w.logger.Panic("error in StartProcess", zap.String("culprit", "Start"), zap.Error(err))
 	}
-	if len(scannedStreams) > 0 {
-		w.logger.Info("std scan enabled", zap.String("wakeupSentinel", w.WakeupSentinel), zap.Bool("logScans", w.LogScans), zap.Any("logFilter", w.LogFilter))
-		w.enableStdScans(scannedStreams)
+	for _, processEnd := range processEnds {
+		processEnd.Close()
 	}
+	w.runMu.Lock()
+	w.run = processRun{cmd: cmd, exited: exited, start: time.Now()}
+	w.runMu.Unlock()
+	streamsDone := w.enableStdScans(scannedStreams, scannedFiles, exited)
 	w.logger.Info("process started")
-	w.processStart = time.Now()
+
+	go func(cmd *exec.Cmd) {
+		cmd.Wait()
+		w.reaper.release(cmd.Process.Pid)
+		// Let the scans read the last lines, unless a descendant of the
+		// process keeps its output open
+		select {
+		case <-streamsDone:
+		case <-time.After(time.Second):
+		}
+		w.processExit = time.Now()
+		close(exited)
+	}(cmd)
+}
+
+// setupCgroup creates the cgroup of the process, or reuses it on restarts,
+// and sets the process to be cloned into it. The returned file must be
+// closed once the process started.
+func (w *Wrapped) setupCgroup(cmd *exec.Cmd) (*os.File, error) {
+	var cgroup *os.File
+	var err error
+	if w.cgroupDir != "" {
+		if cgroup, err = os.Open(w.cgroupDir); err != nil {
+			return nil, fmt.Errorf("os.Open / %w", err)
+		}
+	} else {
+		limits := cgroupLimits{
+			MemoryMax:  w.CgroupMemoryMax,
+			MemoryHigh: w.CgroupMemoryHigh,
+			CpuMax:     w.CgroupCpuMax,
+			PidsMax:    w.CgroupPidsMax,
+		}
+		w.logger.Debug("set cmd cgroup", zap.String("name", w.CgroupName), zap.Any("limits", limits))
+		if cgroup, err = setupProcessCgroup(w.CgroupName, limits); err != nil {
+			return nil, fmt.Errorf("setupProcessCgroup / %w", err)
+		}
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(cgroup.Fd())
+	w.cgroupDir = cgroup.Name()
+	return cgroup, nil
+}
+
+// OomKilled tells if the OOM killer killed processes in the process cgroup
+func (w *Wrapped) OomKilled() bool {
+	if w.cgroupDir == "" {
+		return false
+	}
+	kills, err := cgroupOomKills(w.cgroupDir)
+	if err != nil {
+		w.logger.Error("error in OomKilled", zap.String("culprit", "cgroupOomKills"), zap.Error(err))
+		return false
+	}
+	return kills > 0
+}
+
+// ProcessExited return a channel closed when the process has exited
+func (w *Wrapped) ProcessExited() <-chan struct{} {
+	return w.currentRun().exited
+}
+
+// ProcessExitCode return the exit code of the process, or 128+signal if it
+// was killed by a signal. Only meaningful once the process exited.
+func (w *Wrapped) ProcessExitCode() int {
+	return processExitCode(w.currentRun().cmd.ProcessState)
+}
+
+// processRun is one run of the process. RestartProcess replaces it while
+// hooks, signals and the main loop read it from other goroutines.
+type processRun struct {
+	cmd    *exec.Cmd
+	exited chan struct{}
+	start  time.Time
+}
+
+// currentRun return the run of the process started last
+func (w *Wrapped) currentRun() processRun {
+	w.runMu.Lock()
+	defer w.runMu.Unlock()
+	return w.run
+}
+
+// stopState return the reason given to StopProcess, and whether it was
+// called. Hooks read it from other goroutines.
+func (w *Wrapped) stopState() (StopReason, bool) {
+	w.stopMu.Lock()
+	defer w.stopMu.Unlock()
+	return w.stopReason, w.stopping
 }
 
-func (w *Wrapped) enableStdScans(streams []io.ReadCloser) {
+// ExitCode return the code the wrapper should exit with, derived from the
+// reason given to StopProcess
+func (w *Wrapped) ExitCode() int {
+	reason, _ := w.stopState()
+	return reason.ExitCode(w.currentRun().cmd.ProcessState)
+}
+
+// enableStdScans scans the output streams and files. Return a channel closed
+// once the output streams are completely read.
+func (w *Wrapped) enableStdScans(streams []outputStream, files []*tailer, exited <-chan struct{}) <-chan struct{} {
 	logChan := make(chan string, 60)
-	wakeupChan := make(chan string, 60)
-	for _, stream := range streams {
-		scanner := bufio.NewScanner(stream)
-		go func() {
-			for scanner.Scan() {
-				line := scanner.Text()
-				line = strings.TrimSpace(line)
-				if w.LogScans {
-					if len(w.LogFilter) > 0 {
-						for _, word := range w.LogFilter {
-							if strings.Contains(line, word) {
-								logChan <- line
-								break
-							}
-						}
-					} else {
-						logChan <- line
+	outputChan := make(chan string, 600)
+	wakeups := newQueue[string]()
+	matches := newQueue[ruleMatch]()
+	lagChan := make(chan time.Time, 60)
+	scanLine := func(line string) {
+		line = strings.TrimSpace(line)
+		w.lastLines.add(line)
+		w.watchdog.observe(line)
+		if w.console != nil {
+			w.console.broadcast(line)
+		}
+		// Scans never block, so that a slow consumer cannot stall the
+		// process on its writes. Logs, output files and lag counts may be
+		// dropped; the sentinel and the rules change the state and are
+		// queued without bound instead.
+		if w.LogScans {
+			if len(w.LogFilter) > 0 {
+				for _, word := range w.LogFilter {
+					if strings.Contains(line, word) {
+						trySend(logChan, line, w.logDrops, w.logger)
+						break
 					}
 				}
-				if w.WakeupSentinel != "" && strings.Contains(line, w.WakeupSentinel) {
-					wakeupChan <- line
-				}
+			} else {
+				trySend(logChan, line, w.logDrops, w.logger)
+			}
+		}
+		if w.outputFile != nil {
+			trySend(outputChan, line, w.outputDrops, w.logger)
+		}
+		if w.WakeupSentinel != "" && strings.Contains(line, w.WakeupSentinel) {
+			wakeups.push(line)
+		}
+		if w.lag != nil && w.lag.match(line) {
+			trySend(lagChan, time.Now(), w.lagDrops, w.logger)
+		}
+		for _, rule := range w.rules {
+			if groups, ok := rule.match(line); ok {
+				matches.push(ruleMatch{rule: rule, line: line, groups: groups})
+			}
+		}
+	}
+	// Channels are closed once every source is done, so that the consumers
+	// of a process do not outlive it when it is restarted
+	sources := sync.WaitGroup{}
+	streamSources := sync.WaitGroup{}
+	for _, stream := range streams {
+		sources.Add(1)
+		streamSources.Add(1)
+		go func() {
+			defer sources.Done()
+			defer streamSources.Done()
+			defer stream.reader.Close()
+			if err := readLines(stream.reader, stream.passthrough, scanLine); err != nil {
+				w.logger.Error("error in enableStdScans", zap.String("culprit", "readLines"), zap.Error(err))
 			}
 		}()
 	}
+	if len(streams) > 0 || len(files) > 0 {
+		w.logger.Info("std scan enabled", zap.String("wakeupSentinel", w.WakeupSentinel), zap.Bool("logScans", w.LogScans), zap.Any("logFilter", w.LogFilter), zap.Strings("scanFiles", w.ScanFiles))
+	}
+	streamsDone := make(chan struct{})
+	go func() {
+		streamSources.Wait()
+		close(streamsDone)
+	}()
+	for _, file := range files {
+		sources.Add(1)
+		go func() {
+			defer sources.Done()
+			file.run(exited, scanLine)
+		}()
+	}
+	go func() {
+		sources.Wait()
+		close(logChan)
+		close(outputChan)
+		wakeups.close()
+		matches.close()
+		close(lagChan)
+	}()
 	go func() {
+		// The wrapper stacktrace is meaningless for the game errors
+		gameLogger := w.logger.WithOptions(zap.AddStacktrace(zapcore.FatalLevel))
 		for line := range logChan {
-			w.logger.Info(line)
+			logLine(gameLogger, w.LogFormat, line)
 		}
 	}()
+	outputDone := make(chan struct{})
+	w.outputDone = outputDone
 	go func() {
-		for line := range wakeupChan {
-			timeSinceStart := time.Now().Sub(w.processStart)
+		defer close(outputDone)
+		for line := range outputChan {
+			if err := w.outputFile.writeLine(line); err != nil {
+				w.logger.Error("error in enableStdScans", zap.String("culprit", "writeLine"), zap.Error(err))
+			}
+		}
+	}()
+	go func() {
+		for t := range lagChan {
+			w.recordLag(t)
+		}
+	}()
+	go func() {
+		for line, ok := wakeups.pop(); ok; line, ok = wakeups.pop() {
 			w.logger.Info("sentinel found", zap.String("sentinel", line))
-			w.NotifyBackend("server-ready", fmt.Sprintf("The server is ready ! (started in %.2fs)", timeSinceStart.Seconds()))
+			w.markReady()
+		}
+	}()
+	go func() {
+		for match, ok := matches.pop(); ok; match, ok = matches.pop() {
+			w.applyRule(match)
 		}
 	}()
+	return streamsDone
+}
+
+func (w *Wrapped) markReady() {
+	select {
+	case w.readyC <- struct{}{}:
+	default:
+	}
+	timeSinceStart := time.Now().Sub(w.currentRun().start)
+	msg := fmt.Sprintf("The server is ready ! (started in %.2fs)", timeSinceStart.Seconds())
+	if info := w.queryImmediately(); info != nil {
+		msg = fmt.Sprintf("%s (%v)", msg, *info)
+	}
+	w.NotifyBackend("server-ready", msg)
+	if err := w.runHook(PhaseOnReady); err != nil {
+		w.logger.Error("error in markReady", zap.String("culprit", "runHook"), zap.String("phase", PhaseOnReady), zap.Error(err))
+	}
+}
+
+// applyRule triggers the action of a matched rule. Rules are applied one at
+// a time, from a single goroutine.
+func (w *Wrapped) applyRule(match ruleMatch) {
+	msg := match.render()
+	w.logger.Debug("rule matched", zap.String("pattern", match.rule.Pattern), zap.String("action", match.rule.Action), zap.Any("groups", match.groups))
+	switch match.rule.Action {
+	case RuleNotify:
+		w.NotifyBackend(match.rule.Level, msg)
+	case RuleLog:
+		fields := []zap.Field{}
+		for name, value := range match.groups {
+			fields = append(fields, zap.String(name, value))
+		}
+		w.logger.Info(msg, fields...)
+	case RuleReady:
+		w.logger.Info("ready rule matched", zap.String("line", match.line))
+		w.markReady()
+	case RulePlayerJoin:
+		count := w.players.join(match.groups[playerGroup])
+		w.logger.Info("player joined", zap.String("player", match.groups[playerGroup]), zap.Int("players", count))
+		if match.rule.Message != "" {
+			w.NotifyBackend(match.rule.Level, msg)
+		}
+	case RulePlayerLeave:
+		count := w.players.leave(match.groups[playerGroup])
+		w.logger.Info("player left", zap.String("player", match.groups[playerGroup]), zap.Int("players", count))
+		if match.rule.Message != "" {
+			w.NotifyBackend(match.rule.Level, msg)
+		}
+	case RuleSave:
+		if len(w.PersistFiles) == 0 {
+			w.logger.Warn("save rule matched without persisted files")
+			return
+		}
+		w.logger.Info("save rule matched", zap.String("line", match.line))
+		// The upload may take minutes, the next rules must not wait for it
+		go w.saveData()
+	case RuleStop:
+		w.logger.Info("stop rule matched", zap.String("line", match.line))
+		select {
+		case w.stopRequests <- msg:
+		default:
+		}
+	}
+}
+
+// recordLag counts a lag line, and warns the backend when the lag lines in
+// the window reach the threshold. The lagEvents field is a running counter
+// for metric filters.
+func (w *Wrapped) recordLag(t time.Time) {
+	inWindow, total, warn := w.lag.record(t)
+	w.logger.Info("lag detected", zap.Int("lagInWindow", inWindow), zap.Int64("lagEvents", total))
+	if warn {
+		w.logger.Warn("server lagging", zap.Int("lagInWindow", inWindow), zap.Duration("window", w.LagWindow))
+		w.NotifyBackend("warning", w.WithPlayers(fmt.Sprintf("Server lagging (%d lag warnings in %v)", inWindow, w.LagWindow)))
+	}
 }
 
-func (w *Wrapped) PollProcessPackets() bool {
-	packetFound, err := PollFilteredIface(w.iface, w.SniffFilter, w.SniffTimeout)
+// ProbeLiveness writes the liveness command on the process stdin. The
+// console, if any, owns the stdin and serialises the writes.
+func (w *Wrapped) ProbeLiveness() {
+	line := w.LivenessCommand + "\n"
+	var err error
+	if w.console != nil {
+		err = w.console.write(line)
+	} else {
+		_, err = io.WriteString(w.stdin, line)
+	}
 	if err != nil {
-		w.logger.Error("error polling network",
-			zap.String("iface", w.iface),
-			zap.String("filter", w.SniffFilter),
-			zap.Error(err),
-		)
-		if w.PanicOnSocketError {
-			w.ShutdownWhenInEc2()
-			panic(err)
+		w.logger.Error("error in ProbeLiveness", zap.String("culprit", "WriteString"), zap.Error(err))
+		return
+	}
+	w.watchdog.probed()
+}
+
+// Hung return why the process is deemed hung, if it is. Busy tells whether
+// players are present, in which case the process is expected to output.
+func (w *Wrapped) Hung(busy bool) (string, bool) {
+	return w.watchdog.hung(busy)
+}
+
+// DetectsReadiness tells if the server readiness is detected, from the
+// wakeup sentinel or a ready rule
+func (w *Wrapped) DetectsReadiness() bool {
+	if w.WakeupSentinel != "" {
+		return true
+	}
+	for _, rule := range w.rules {
+		if rule.Action == RuleReady {
+			return true
+		}
+	}
+	return false
+}
+
+// Ready return a channel receiving a value when the server is ready
+func (w *Wrapped) Ready() <-chan struct{} {
+	return w.readyC
+}
+
+// LastOutput return the last lines of output, truncated to maxLen bytes
+func (w *Wrapped) LastOutput(maxLen int) string {
+	return w.lastLines.tail(maxLen)
+}
+
+// TracksPlayers tells if player presence is tracked from join rules or
+// server queries
+func (w *Wrapped) TracksPlayers() bool {
+	if w.QueryProtocol != "" {
+		return true
+	}
+	for _, rule := range w.rules {
+		if rule.Action == RulePlayerJoin {
+			return true
 		}
 	}
-	return packetFound
+	return false
 }
 
-func (w *Wrapped) StopProcess() {
-	// Grace delay after warning
-	time.Sleep(w.SignalGraceDelay)
+// PlayersChanged return a channel receiving the player count when it changes
+func (w *Wrapped) PlayersChanged() <-chan int {
+	return w.players.changed
+}
 
-	// Stop the process
-	w.cmd.Process.Signal(w.sigWith)
-	w.cmd.Wait()
+// PlayerCount return the number of players currently connected
+func (w *Wrapped) PlayerCount() int {
+	return w.players.count()
+}
+
+// PlayersReported tells if the player count currently comes from the server
+// answering queries, in which case it is authoritative over the network
+// activity
+func (w *Wrapped) PlayersReported() bool {
+	return w.players.isReported()
+}
+
+// Consecutive failed queries after which the count reported by the server
+// is dropped, so that a lost reply does not publish the count of the rules
+const queryFailureLimit = 3
+
+// StartQueryProber queries the server every QueryInterval for its player
+// count, and when queryImmediately asks for it. Until the server answers,
+// and after it stops answering, players are tracked from the rules.
+func (w *Wrapped) StartQueryProber() {
+	if w.QueryProtocol == "" {
+		return
+	}
+	w.logger.Info("querying server for players", zap.String("protocol", w.QueryProtocol), zap.String("address", w.QueryAddress))
+	go func() {
+		ticker := time.NewTicker(w.QueryInterval)
+		defer ticker.Stop()
+		failures := 0
+		probe := func() *serverInfo {
+			info, err := queryServer(w.QueryProtocol, w.QueryAddress, w.QueryTimeout)
+			if err != nil {
+				failures++
+				if w.players.isReported() && failures >= queryFailureLimit {
+					w.logger.Warn("server stopped answering queries", zap.Int("failures", failures), zap.Error(err))
+					w.players.unreport()
+				} else {
+					w.logger.Debug("server not answering queries", zap.Int("failures", failures), zap.Error(err))
+				}
+				return nil
+			}
+			failures = 0
+			wasReported, previous := w.players.isReported(), w.players.count()
+			if count := w.players.report(info.Players, info.PlayerNames); !wasReported || count != previous {
+				w.logger.Info("players reported", zap.Int("players", count), zap.Int("maxPlayers", info.MaxPlayers), zap.String("map", info.Map))
+			}
+			return &info
+		}
+		for {
+			select {
+			case <-ticker.C:
+				probe()
+			case reply := <-w.queryNow:
+				reply <- probe()
+			}
+		}
+	}()
+}
+
+// queryImmediately has the prober query the server now, and return the
+// answer, or nil if the server did not answer. It runs from the consumers of
+// the scans, never from the scans themselves.
+func (w *Wrapped) queryImmediately() *serverInfo {
+	if w.QueryProtocol == "" {
+		return nil
+	}
+	reply := make(chan *serverInfo, 1)
+	select {
+	case w.queryNow <- reply:
+	default:
+		// Already asked
+		return nil
+	}
+	select {
+	case info := <-reply:
+		return info
+	case <-time.After(2*w.QueryTimeout + time.Second):
+		// A periodic query may be running first
+		return nil
+	}
+}
+
+// WithPlayers appends the connected players to a message, if any
+func (w *Wrapped) WithPlayers(msg string) string {
+	if w.players.count() == 0 {
+		return msg
+	}
+	return fmt.Sprintf("%s (players: %s)", msg, w.players)
+}
+
+// StopRequested return a channel receiving the message of the stop rules
+// that matched
+func (w *Wrapped) StopRequested() <-chan string {
+	return w.stopRequests
+}
+
+// StartActivityMonitor accounts the network activity in the background,
+// from LSDC2_ACTIVITY_SOURCE. While enough clients are active, the activity
+// is published on NetworkActive every SniffInterval.
+func (w *Wrapped) StartActivityMonitor() {
+	traffic := newTrafficStats(w.ClientWindow)
+	switch w.ActivitySource {
+	case ActivitySourceProc:
+		w.logger.Info("monitoring activity from sockets", zap.Any("ports", w.ActivityPorts))
+		go w.monitorProcNet()
+		return
+	case ActivitySourceConntrack:
+		w.logger.Info("monitoring activity from conntrack", zap.Any("ports", w.ActivityPorts))
+		go w.monitorConntrack(traffic)
+		return
+	}
+
+	w.openCaptures()
+	for _, target := range w.sniffTargets {
+		s, err := w.openSniffer(target, traffic)
+		if err != nil {
+			w.handleSocketError(target, err)
+			continue
+		}
+		go func() {
+			defer s.close()
+			w.handleSocketError(target, s.run())
+		}()
+	}
+
+	go func() {
+		ticker := time.NewTicker(w.SniffInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			w.publishActiveClients(traffic.activity(now, w.ClientMinPps))
+		}
+	}()
+}
+
+// openSniffer compiles the filter of a target and opens its sniffer, plus
+// the capture of its unmatched packets if enabled
+func (w *Wrapped) openSniffer(target sniffTarget, traffic *trafficStats) (*sniffer, error) {
+	filter, err := compileBPFFilter(target.iface, target.filter)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newSniffer(target.iface, filter, w.SniffTimeout, traffic)
+	if err != nil {
+		return nil, err
+	}
+	s.capture = w.capture
+	if w.unmatched != nil {
+		w.startUnmatchedCapture(target, filter)
+	}
+	return s, nil
+}
+
+// startUnmatchedCapture captures the packets rejected by the filter of a
+// target, from a sniffer of its own that stops with the capture. Errors are
+// only logged, the capture is a debug aid.
+func (w *Wrapped) startUnmatchedCapture(target sniffTarget, filter []unix.SockFilter) {
+	inverted, err := invertFilter(filter)
+	if err != nil {
+		w.logger.Error("error in startUnmatchedCapture", zap.String("culprit", "invertFilter"), zap.String("iface", target.iface), zap.Error(err))
+		return
+	}
+	s, err := newSniffer(target.iface, inverted, w.SniffTimeout, nil)
+	if err != nil {
+		w.logger.Error("error in startUnmatchedCapture", zap.String("culprit", "newSniffer"), zap.String("iface", target.iface), zap.Error(err))
+		return
+	}
+	s.capture = w.unmatched
+	go func() {
+		defer s.close()
+		if err := s.run(); err != nil {
+			w.logger.Error("error in startUnmatchedCapture", zap.String("culprit", "run"), zap.String("iface", target.iface), zap.Error(err))
+		}
+	}()
+}
+
+// openCaptures creates the pcap files sampling the matched packets, and the
+// unmatched ones if asked, from LSDC2_SNIFF_CAPTURE
+func (w *Wrapped) openCaptures() {
+	if w.SniffCapture == "" {
+		return
+	}
+	w.capture = w.openCapture(w.SniffCapture)
+	if w.SniffCaptureUnmatched {
+		w.unmatched = w.openCapture(unmatchedCapturePath(w.SniffCapture))
+	}
+}
+
+func (w *Wrapped) openCapture(path string) *pcapWriter {
+	capture, err := newPcapWriter(path, w.SniffCaptureCount)
+	if err != nil {
+		w.logger.Error("error in openCapture", zap.String("culprit", "newPcapWriter"), zap.String("path", path), zap.Error(err))
+		return nil
+	}
+	w.logger.Info("capturing packets", zap.String("path", path), zap.Int("count", w.SniffCaptureCount))
+	go func() {
+		<-capture.done
+		w.logger.Info("packet capture complete", zap.String("path", path), zap.Int("packets", capture.written()))
+	}()
+	return capture
+}
+
+// SniffTest prints every second the packets matched on each sniffed
+// interface, and the clients sending them as the wrapper counts them. Return
+// on the first socket error.
+func (w *Wrapped) SniffTest(out io.Writer) error {
+	type sniffTest struct {
+		target  sniffTarget
+		sniffer *sniffer
+		traffic *trafficStats
+		packets int64
+	}
+
+	w.openCaptures()
+	tests := []*sniffTest{}
+	errC := make(chan error, len(w.sniffTargets))
+	for _, target := range w.sniffTargets {
+		filter := target.filter
+		if filter == "" {
+			filter = "(all packets)"
+		}
+		fmt.Fprintf(out, "%s: %s\n", target.iface, filter)
+
+		traffic := newTrafficStats(w.ClientWindow)
+		s, err := w.openSniffer(target, traffic)
+		if err != nil {
+			return fmt.Errorf("%s / %w", target.iface, err)
+		}
+		defer s.close()
+		go func() {
+			errC <- fmt.Errorf("%s / %w", target.iface, s.run())
+		}()
+		tests = append(tests, &sniffTest{target: target, sniffer: s, traffic: traffic})
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-errC:
+			return err
+		case now := <-ticker.C:
+			fields := []string{now.Format(time.TimeOnly)}
+			for _, test := range tests {
+				packets := test.sniffer.packets.Load()
+				activity := test.traffic.activity(now, w.ClientMinPps)
+				field := fmt.Sprintf("%s %d pkt/s %d clients", test.target.iface, packets-test.packets, activity.Clients)
+				if activity.Clients >= max(w.ClientMinCount, 1) {
+					field += " (active)"
+				}
+				fields = append(fields, field)
+				test.packets = packets
+			}
+			fmt.Fprintln(out, strings.Join(fields, " | "))
+		}
+	}
+}
+
+// monitorProcNet counts the distinct peers of the sockets of the game. There
+// is no packet count, every peer is an active client.
+func (w *Wrapped) monitorProcNet() {
+	ticker := time.NewTicker(w.SniffInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		peers, err := procNetPeers(w.activePorts)
+		if err != nil {
+			w.logger.Error("error in monitorProcNet", zap.String("culprit", "procNetPeers"), zap.Error(err))
+			continue
+		}
+		distinct := map[netip.Addr]bool{}
+		for _, peer := range peers {
+			distinct[peer] = true
+		}
+		w.publishActiveClients(NetworkActivity{Time: now, Clients: len(distinct)})
+	}
+}
+
+// monitorConntrack accounts the traffic of the tracked flows towards the
+// game, from the growth of their counters between two reads. Without
+// counters, a flow counts as one packet per read while it is tracked.
+func (w *Wrapped) monitorConntrack(traffic *trafficStats) {
+	ticker := time.NewTicker(w.SniffInterval)
+	defer ticker.Stop()
+	// The counters of a flow cover its whole life: the flows already tracked
+	// are read once first, so that only their traffic from now on counts
+	previous, err := readConntrack(w.activePorts)
+	if err != nil {
+		w.logger.Error("error in monitorConntrack", zap.String("culprit", "readConntrack"), zap.Error(err))
+	}
+	for now := range ticker.C {
+		flows, err := readConntrack(w.activePorts)
+		if err != nil {
+			w.logger.Error("error in monitorConntrack", zap.String("culprit", "readConntrack"), zap.Error(err))
+			continue
+		}
+		if previous == nil {
+			previous = flows
+			continue
+		}
+		for key, flow := range flows {
+			if !flow.counted {
+				traffic.addCount(flow.src, 1, 0, now)
+				continue
+			}
+			last := previous[key]
+			if packets := flow.packets - last.packets; packets > 0 {
+				traffic.addCount(flow.src, packets, flow.bytes-last.bytes, now)
+			}
+		}
+		previous = flows
+		w.publishActiveClients(traffic.activity(now, w.ClientMinPps))
+	}
+}
+
+// publishActiveClients publishes the activity if enough clients are active
+func (w *Wrapped) publishActiveClients(activity NetworkActivity) {
+	if activity.Clients >= max(w.ClientMinCount, 1) {
+		w.publishActivity(activity)
+	}
+}
+
+func (w *Wrapped) handleSocketError(target sniffTarget, err error) {
+	w.logger.Error("error sniffing network",
+		zap.String("iface", target.iface),
+		zap.String("filter", target.filter),
+		zap.Error(err),
+	)
+	if w.PanicOnSocketError {
+		w.ShutdownWhenInEc2()
+		panic(err)
+	}
+}
+
+// publishActivity replaces the activity waiting in the channel, if any, so
+// that the main loop always gets the latest one
+func (w *Wrapped) publishActivity(activity NetworkActivity) {
+	select {
+	case <-w.activity:
+	default:
+	}
+	select {
+	case w.activity <- activity:
+	default:
+	}
+}
+
+// NetworkActive return a channel receiving the network activity, while
+// enough clients are active
+func (w *Wrapped) NetworkActive() <-chan NetworkActivity {
+	return w.activity
+}
+
+func (w *Wrapped) StopProcess(reason StopReason) {
+	w.stopMu.Lock()
+	w.stopReason = reason
+	w.stopping = true
+	w.stopMu.Unlock()
+	w.logger.Info("stopping process", zap.Stringer("reason", reason))
+
+	if reason != StopProcessExited {
+		// Grace delay after warning
+		time.Sleep(w.SignalGraceDelay)
+
+		// Stop the process
+		w.currentRun().cmd.Process.Signal(w.sigWith)
+	}
+	<-w.currentRun().exited
+	w.logger.Info("process exited", zap.Int("exitCode", w.ProcessExitCode()))
+	w.logger.Info("scanned lines dropped",
+		zap.Int64("log", w.logDrops.count.Load()),
+		zap.Int64("output", w.outputDrops.count.Load()),
+		zap.Int64("lag", w.lagDrops.count.Load()),
+	)
+	if w.lag != nil {
+		w.logger.Info("lag summary", zap.Int64("lagEvents", w.lag.count()))
+	}
+
+	if w.console != nil {
+		w.console.close()
+	}
+
+	if reason == StopProcessExited && w.ProcessExitCode() != 0 && w.CrashReport && w.Bucket != "" {
+		w.reportCrash()
+	}
+
+	if w.outputFile != nil {
+		w.uploadOutputFiles()
+	}
 
 	// Small wait to sync file system
 	time.Sleep(1 * time.Second)
 
 	if len(w.PersistFiles) > 0 {
-		w.logger.Info("S3 upload")
-		err := w.archiveData()
+		w.saveData()
+	}
+
+	if err := w.runHook(PhaseBeforeShutdown); errors.Is(err, ErrHookVeto) {
+		w.logger.Info("shutdown vetoed by hook")
+	} else {
 		if err != nil {
-			w.logger.Error("error in StopProcess", zap.String("culprit", "archiveData"), zap.Error(err))
-			w.NotifyBackend("error", "Error when exporting savegame to S3")
-		} else {
-			w.NotifyBackend("info", "Savegame exported to S3")
+			w.logger.Error("error in StopProcess", zap.String("culprit", "runHook"), zap.String("phase", PhaseBeforeShutdown), zap.Error(err))
+			w.NotifyBackend("error", "Error in before-shutdown hook")
 		}
+		w.ShutdownWhenInEc2()
 	}
 
-	w.ShutdownWhenInEc2()
-
 	w.logger.Info("goodbye !")
 }
 
+// reportCrash uploads a crash bundle next to the savegame
+func (w *Wrapped) reportCrash() {
+	run := w.currentRun()
+	report := newCrashReport(w.Server, run.cmd.ProcessState, run.start, w.processExit)
+	report.OomKilled = w.OomKilled()
+	if freeMemoryMiB, err := GetFreeMemoryMiB(); err == nil {
+		report.FreeMemoryMiB = freeMemoryMiB
+	}
+	if w.cgroupDir != "" {
+		if peak, err := cgroupMemoryPeak(w.cgroupDir); err == nil {
+			report.CgroupMemoryPeak = peak
+		}
+	}
+
+	dir := w.Home
+	if dir == "" {
+		dir, _ = os.Getwd()
+	}
+	corePath := findCoreFile(dir, run.cmd.Process.Pid, run.start)
+
+	key := fmt.Sprintf("%s-crash-%s.zip", w.Server, w.processExit.UTC().Format("20060102T150405Z"))
+	w.logger.Info("uploading crash report", zap.String("key", key), zap.String("core", corePath))
+	if err := uploadCrashBundle(w.Bucket, key, report, w.lastLines.last(), corePath); err != nil {
+		w.logger.Error("error in reportCrash", zap.String("culprit", "uploadCrashBundle"), zap.Error(err))
+		w.NotifyBackend("error", "Error when exporting crash report to S3")
+		return
+	}
+	w.NotifyBackend("info", fmt.Sprintf("Crash report exported to S3 (%s)", key))
+}
+
+// uploadOutputFiles closes the output files of the session, and uploads them
+// under a prefix named after the server and the session start
+func (w *Wrapped) uploadOutputFiles() {
+	// Let the last lines be written, the tailed files stop once the process
+	// exited
+	select {
+	case <-w.outputDone:
+	case <-time.After(2 * time.Second):
+	}
+	paths := w.outputFile.close()
+	if !w.OutputUpload || w.Bucket == "" {
+		return
+	}
+
+	prefix := fmt.Sprintf("%s-logs/%s", w.Server, w.sessionStart.UTC().Format("20060102T150405Z"))
+	w.logger.Info("uploading output files", zap.String("prefix", prefix), zap.Int("files", len(paths)))
+	for _, path := range paths {
+		key := prefix + "/" + filepath.Base(path)
+		if err := uploadToS3(w.Bucket, key, path); err != nil {
+			w.logger.Error("error in uploadOutputFiles", zap.String("culprit", "uploadToS3"), zap.String("key", key), zap.Error(err))
+			w.NotifyBackend("error", "Error when exporting server logs to S3")
+			return
+		}
+	}
+	w.NotifyBackend("info", fmt.Sprintf("Server logs exported to S3 (%s)", prefix))
+}
+
+// saveData archives the savegame, surrounded by the save hooks. Saves are
+// serialised, as they may be triggered by rules while the process runs.
+func (w *Wrapped) saveData() {
+	w.saveMu.Lock()
+	defer w.saveMu.Unlock()
+
+	if err := w.runHook(PhaseBeforeSave); errors.Is(err, ErrHookVeto) {
+		w.logger.Info("save vetoed by hook")
+		w.NotifyBackend("warning", "Savegame export skipped by before-save hook")
+		return
+	} else if err != nil {
+		w.logger.Error("error in saveData", zap.String("culprit", "runHook"), zap.String("phase", PhaseBeforeSave), zap.Error(err))
+		w.NotifyBackend("error", "Savegame export skipped after before-save hook failure")
+		return
+	}
+
+	w.logger.Info("S3 upload")
+	err := w.archiveData()
+	if err != nil {
+		w.logger.Error("error in StopProcess", zap.String("culprit", "archiveData"), zap.Error(err))
+		w.NotifyBackend("error", "Error when exporting savegame to S3")
+		return
+	}
+	w.NotifyBackend("info", "Savegame exported to S3")
+
+	if err := w.runHook(PhaseAfterSave); err != nil {
+		w.logger.Error("error in saveData", zap.String("culprit", "runHook"), zap.String("phase", PhaseAfterSave), zap.Error(err))
+		w.NotifyBackend("error", "Error in after-save hook")
+	}
+}
+
 func (w *Wrapped) ShutdownWhenInEc2() {
 	// Clear early return if this is true
 	if w.DisableShutdownCalls {
@@ -277,7 +1424,7 @@ func (w *Wrapped) ShutdownWhenInEc2() {
 		w.logger.Info("issue shutdown")
 		cmd := exec.Command("shutdown", "now")
 
-		err := cmd.Run()
+		err := w.reaper.runManaged(cmd)
 		if err != nil {
 			w.logger.Error("error in StopProcess", zap.String("culprit", "Run"), zap.Error(err))
 			w.NotifyBackend("error", "Error worth checking in the EC2 instance")
@@ -285,6 +1432,92 @@ func (w *Wrapped) ShutdownWhenInEc2() {
 	}
 }
 
+// BecomeSubreaper makes orphaned descendants of the wrapper reparent to
+// it instead of the host init, so that they can be reaped
+func (w *Wrapped) BecomeSubreaper() error {
+	if err := setChildSubreaper(); err != nil {
+		return fmt.Errorf("setChildSubreaper / %w", err)
+	}
+	w.logger.Info("running as child subreaper")
+	return nil
+}
+
+// ReapsOrphans tells if the wrapper is responsible for reaping zombies,
+// either because it is PID 1 or because it is a subreaper
+func (w *Wrapped) ReapsOrphans() bool {
+	return w.Subreaper || os.Getpid() == 1
+}
+
+func (w *Wrapped) ReapOrphans() {
+	reaped, err := w.reaper.reapZombies()
+	if err != nil {
+		w.logger.Error("error in ReapOrphans", zap.String("culprit", "reapZombies"), zap.Error(err))
+	}
+	if len(reaped) > 0 {
+		w.logger.Debug("reaped orphans", zap.Ints("pids", reaped))
+	}
+}
+
+// ForwardedSignals return the signals that must be relayed to the process
+// instead of stopping it
+func (w *Wrapped) ForwardedSignals() []os.Signal {
+	signals := []os.Signal{}
+	for sig := range w.forwardedSignals {
+		signals = append(signals, sig)
+	}
+	return signals
+}
+
+// ForwardSignal relays sig to the process if it is configured for
+// forwarding. Return false if the signal is not forwarded.
+func (w *Wrapped) ForwardSignal(sig os.Signal) bool {
+	sent, ok := w.forwardedSignals[sig]
+	if !ok {
+		return false
+	}
+	w.logger.Info("forwarding signal", zap.Stringer("received", sig), zap.Stringer("sent", sent))
+	if err := w.currentRun().cmd.Process.Signal(sent); err != nil {
+		w.logger.Error("error in ForwardSignal", zap.String("culprit", "Signal"), zap.Error(err))
+	}
+	return true
+}
+
+// renderTemplates renders the config templates. Relative destinations are
+// taken from Home.
+func (w *Wrapped) renderTemplates() error {
+	data := templateData{
+		Server: w.Server,
+		Home:   w.Home,
+		Uid:    w.Uid,
+		Gid:    w.Gid,
+		Env:    environMap(),
+	}
+	if w.InEc2Instance {
+		var err error
+		if data.InstanceId, err = GetInstanceId(); err != nil {
+			return fmt.Errorf("GetInstanceId / %w", err)
+		}
+		if data.PublicIp, err = GetPublicIp(); err != nil {
+			w.logger.Warn("no public IP for templates", zap.Error(err))
+		}
+	}
+
+	for _, spec := range w.Templates {
+		src, dst, err := parseTemplateSpec(spec)
+		if err != nil {
+			return fmt.Errorf("parseTemplateSpec / %w", err)
+		}
+		if !filepath.IsAbs(dst) {
+			dst = filepath.Join(w.Home, dst)
+		}
+		w.logger.Debug("render template", zap.String("template", src), zap.String("destination", dst))
+		if err := renderTemplate(src, dst, data, w.Uid, w.Gid); err != nil {
+			return fmt.Errorf("renderTemplate %v / %w", src, err)
+		}
+	}
+	return nil
+}
+
 func (w *Wrapped) retrieveData() error {
 	if w.Zip {
 		return unzipFromS3(w.logger, w.Bucket, w.Server, w.ZipFrom, w.Uid, w.Gid)
@@ -302,6 +1535,10 @@ func (w *Wrapped) archiveData() error {
 }
 
 func (w *Wrapped) NotifyBackend(action string, msg string) {
+	var players []string
+	if w.TracksPlayers() {
+		players = w.players.names()
+	}
 	cmd := struct {
 		Api  string
 		Args any
@@ -311,10 +1548,12 @@ func (w *Wrapped) NotifyBackend(action string, msg string) {
 			ServerName string
 			Action     string
 			Message    string
+			Players    []string `json:",omitempty"`
 		}{
 			ServerName: w.Server,
 			Action:     action,
 			Message:    msg,
+			Players:    players,
 		},
 	}
 	bodyBytes, err := json.Marshal(cmd)
@@ -0,0 +1,84 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// TestRestartProcess restarts the process while hooks and the main loop read
+// it, for the race detector
+func TestRestartProcess(t *testing.T) {
+	hook := filepath.Join(t.TempDir(), "hook.sh")
+	if err := os.WriteFile(hook, []byte("#!/bin/sh\ncat > /dev/null\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("LSDC2_HOOK_ON_READY", hook)
+	t.Setenv("LSDC2_SIGNAL_GRACE_DELAY", "5s")
+	w := NewWrapped(zap.NewNop(), []string{"sleep", "30"})
+	w.launchProcess()
+	first := w.currentRun()
+
+	done := make(chan struct{})
+	readers := sync.WaitGroup{}
+	readers.Add(2)
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := w.runHook(PhaseOnReady); err != nil {
+				t.Errorf("runHook / %v", err)
+			}
+		}
+	}()
+	// As the main loop does
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-done:
+				return
+			case <-w.ProcessExited():
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		// Restart while hooks run
+		time.Sleep(20 * time.Millisecond)
+		w.RestartProcess(false)
+	}
+	close(done)
+	readers.Wait()
+
+	if got := processExitCode(first.cmd.ProcessState); got != 128+int(syscall.SIGTERM) {
+		t.Errorf("first run exit code = %d, want %d", got, 128+int(syscall.SIGTERM))
+	}
+	run := w.currentRun()
+	if run.cmd == first.cmd {
+		t.Fatal("process not replaced")
+	}
+	select {
+	case <-w.ProcessExited():
+		t.Fatal("restarted process already exited")
+	default:
+	}
+	run.cmd.Process.Kill()
+	select {
+	case <-w.ProcessExited():
+	case <-time.After(5 * time.Second):
+		t.Fatal("process exit not seen")
+	}
+	if got := w.ProcessExitCode(); got != 128+int(syscall.SIGKILL) {
+		t.Errorf("exit code = %d, want %d", got, 128+int(syscall.SIGKILL))
+	}
+}
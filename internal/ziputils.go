@@ -131,13 +131,13 @@ func unzipFile(f *zip.File, root string, uid int, gid int) error {
 
 	// Create directory tree
 	if f.FileInfo().IsDir() {
-		if err := mkdirAllChown(filepath.Dir(dst), os.ModePerm, gid, uid); err != nil {
+		if err := mkdirAllChown(filepath.Dir(dst), os.ModePerm, uid, gid); err != nil {
 			return err
 		}
 		return nil
 	}
 
-	if err := mkdirAllChown(filepath.Dir(dst), os.ModePerm, gid, uid); err != nil {
+	if err := mkdirAllChown(filepath.Dir(dst), os.ModePerm, uid, gid); err != nil {
 		return err
 	}
 
@@ -6,13 +6,16 @@ src_dir=$script_dir/..
 mkdir -p $HOME/go/pkg
 
 podman build -f $script_dir/Dockerfile -t lsdc2/serverwrap:build-image $src_dir
+# BUILD_TAGS=pcap links libpcap, for filters the built-in compiler does not
+# support
 podman run \
     --rm \
+    -e BUILD_TAGS \
     -v $src_dir:/go/src \
     -v $HOME/go/pkg:/go/pkg \
     --workdir /go/src \
     lsdc2/serverwrap:build-image \
-    /bin/bash -c 'go get ./... && go build --ldflags  "\
+    /bin/bash -c 'go get ./... && go build -tags "$BUILD_TAGS" --ldflags  "\
         -X main.Version=$(git describe --tags --always --dirty) \
         -X main.Commit=$(git rev-parse HEAD) \
         -X main.BuildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ) \